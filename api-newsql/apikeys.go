@@ -0,0 +1,256 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const apiKeyPrefix = "nsk_"
+
+var (
+	errInvalidAPIKey  = errors.New("invalid API key")
+	errAPIKeyNotFound = errors.New("API key not found")
+)
+
+// apiKey is the stored form of a key. Only the SHA-256 hash of the secret is
+// kept; the plaintext is shown once, when the key is created.
+type apiKey struct {
+	ID        int64      `json:"id"`
+	Name      string     `json:"name"`
+	Prefix    string     `json:"prefix"`
+	Scopes    []string   `json:"scopes"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Key       string     `json:"key,omitempty"`
+}
+
+type apiKeyRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+}
+
+func (req apiKeyRequest) validate() []fieldError {
+	var errs []fieldError
+	if strings.TrimSpace(req.Name) == "" {
+		errs = append(errs, fieldError{Field: "name", Message: "is required"})
+	}
+	if len(req.Scopes) == 0 {
+		errs = append(errs, fieldError{Field: "scopes", Message: "must list at least one scope"})
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(knownScopes, scope) {
+			errs = append(errs, fieldError{Field: "scopes", Message: fmt.Sprintf("unknown scope %q", scope)})
+		}
+	}
+	return errs
+}
+
+func createAPIKey(db *sql.DB, name string, scopes []string) (*apiKey, error) {
+	plain, err := newToken(apiKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &apiKey{
+		Name:      strings.TrimSpace(name),
+		Prefix:    plain[:len(apiKeyPrefix)+8],
+		Scopes:    scopes,
+		CreatedAt: time.Now().UTC(),
+		Key:       plain,
+	}
+
+	result, err := db.Exec("INSERT INTO api_keys (name, prefix, key_hash, scopes, created_at) VALUES (?, ?, ?, ?, ?)",
+		k.Name, k.Prefix, hashToken(plain), strings.Join(scopes, " "), k.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if k.ID, err = result.LastInsertId(); err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+func listAPIKeys(db *sql.DB) ([]*apiKey, error) {
+	rows, err := db.Query("SELECT id, name, prefix, scopes, created_at, revoked_at FROM api_keys ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*apiKey{}
+	for rows.Next() {
+		var k apiKey
+		var scopes string
+		var revokedAt sql.NullTime
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &scopes, &k.CreatedAt, &revokedAt); err != nil {
+			return nil, err
+		}
+		k.Scopes = strings.Fields(scopes)
+		if revokedAt.Valid {
+			k.RevokedAt = &revokedAt.Time
+		}
+		keys = append(keys, &k)
+	}
+
+	return keys, rows.Err()
+}
+
+func revokeAPIKey(db *sql.DB, id int64) error {
+	result, err := db.Exec("UPDATE api_keys SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL", time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errAPIKeyNotFound
+	}
+	return nil
+}
+
+// findAPIKeyPrincipal looks key up in the database of tenantID. Subjects of
+// tenant keys carry the tenant so they never collide with the keys of the
+// default tenant.
+func findAPIKeyPrincipal(db *sql.DB, tenantID, key string) (*principal, error) {
+	var name, scopes string
+	err := db.QueryRow("SELECT name, scopes FROM api_keys WHERE key_hash = ? AND revoked_at IS NULL", hashToken(key)).
+		Scan(&name, &scopes)
+	if err == sql.ErrNoRows {
+		return nil, errInvalidAPIKey
+	} else if err != nil {
+		return nil, err
+	}
+
+	subject := "apikey:" + name
+	if tenantID != "" {
+		subject = "apikey:" + tenantID + "/" + name
+	}
+	return &principal{Subject: subject, Scopes: strings.Fields(scopes), Tenant: tenantID}, nil
+}
+
+func (s *server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var req apiKeyRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	// Only an operator can issue operator keys, which manage every tenant;
+	// an admin key of the default tenant must not be able to mint one.
+	t := tenantFrom(r.Context())
+	p, _ := principalFrom(r.Context())
+	errs := req.validate()
+	if slices.Contains(req.Scopes, scopeOperator) {
+		if t.id != "" {
+			errs = append(errs, fieldError{Field: "scopes", Message: "operator keys can only be created on the default tenant"})
+		} else if p == nil || !slices.Contains(p.Scopes, scopeOperator) {
+			errs = append(errs, fieldError{Field: "scopes", Message: "operator keys can only be created by an operator"})
+		}
+	}
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	k, err := createAPIKey(t.db, req.Name, req.Scopes)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/admin/api-keys/%d", k.ID))
+	writeJSON(w, http.StatusCreated, k)
+}
+
+func (s *server) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	keys, err := listAPIKeys(tenantFrom(r.Context()).db)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"data": keys})
+}
+
+func (s *server) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid API key ID")
+		return
+	}
+
+	err = revokeAPIKey(tenantFrom(r.Context()).db, id)
+	if errors.Is(err, errAPIKeyNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "API key not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runAPIKeyCommand implements "apikey create NAME SCOPE...", "apikey list"
+// and "apikey revoke ID", which is how the first admin key is issued.
+func runAPIKeyCommand(db *sql.DB, args []string, w io.Writer) error {
+	usage := errors.New("usage: apikey create NAME SCOPE... | list | revoke ID")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) < 3 {
+			return usage
+		}
+		req := apiKeyRequest{Name: args[1], Scopes: args[2:]}
+		if errs := req.validate(); len(errs) > 0 {
+			return fmt.Errorf("%s %s", errs[0].Field, errs[0].Message)
+		}
+		k, err := createAPIKey(db, req.Name, req.Scopes)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Created API key %d (%s). Store it now, it will not be shown again:\n%s\n", k.ID, k.Name, k.Key)
+		return nil
+	case "list":
+		keys, err := listAPIKeys(db)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tNAME\tPREFIX\tSCOPES\tSTATUS")
+		for _, k := range keys {
+			status := "active"
+			if k.RevokedAt != nil {
+				status = "revoked " + k.RevokedAt.Format(time.RFC3339)
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, " "), status)
+		}
+		return tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid API key ID %q", args[1])
+		}
+		return revokeAPIKey(db, id)
+	default:
+		return usage
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Only an operator can issue operator keys: an admin key of the default
+// tenant would otherwise mint one and manage every tenant.
+func TestCreateAPIKeyOperatorScope(t *testing.T) {
+	def := newTenant("", newTestDB(t), t.TempDir())
+	other := newTenant("acme", newTestDB(t), t.TempDir())
+
+	tests := []struct {
+		name   string
+		tenant *tenant
+		caller []string
+		scopes string
+		status int
+	}{
+		{"admin mints operator", def, []string{scopeAdmin}, `["operator"]`, http.StatusUnprocessableEntity},
+		{"admin mints admin", def, []string{scopeAdmin}, `["admin", "users:read"]`, http.StatusCreated},
+		{"operator mints operator", def, []string{scopeAdmin, scopeOperator}, `["operator"]`, http.StatusCreated},
+		{"operator key on a tenant", other, []string{scopeAdmin, scopeOperator}, `["operator"]`, http.StatusUnprocessableEntity},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `{"name": "key", "scopes": ` + tt.scopes + `}`
+			req := httptest.NewRequest(http.MethodPost, "/admin/api-keys", strings.NewReader(body))
+			ctx := withTenant(req.Context(), tt.tenant)
+			ctx = withPrincipal(ctx, &principal{Subject: "apikey:caller", Scopes: tt.caller, Tenant: tt.tenant.id})
+
+			rec := httptest.NewRecorder()
+			(&server{}).createAPIKeyHandler(rec, req.WithContext(ctx))
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	// Only the key minted by the operator carries the scope.
+	keys, err := listAPIKeys(def.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	operators := 0
+	for _, k := range keys {
+		if slices.Contains(k.Scopes, scopeOperator) {
+			operators++
+		}
+	}
+	if operators != 1 {
+		t.Errorf("%d operator keys, want 1", operators)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	auditCreate  = "create"
+	auditUpdate  = "update"
+	auditDelete  = "delete"
+	auditRestore = "restore"
+)
+
+// auditEventTypes maps audit actions to the event types of the change feed.
+// A restored user reappears with deleted_at cleared, which consumers see as
+// an update.
+var auditEventTypes = map[string]string{
+	auditCreate:  eventUserCreated,
+	auditUpdate:  eventUserUpdated,
+	auditDelete:  eventUserDeleted,
+	auditRestore: eventUserUpdated,
+}
+
+type auditEntry struct {
+	ID        int64           `json:"id"`
+	UserID    int64           `json:"user_id"`
+	Action    string          `json:"action"`
+	Before    json.RawMessage `json:"before"`
+	After     json.RawMessage `json:"after"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+func (s *server) userHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	entries, err := usersFor(r).History(r.Context(), id)
+	if err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"data": entries})
+}
+
+func rawJSONOrNull(s sql.NullString) json.RawMessage {
+	if !s.Valid {
+		return json.RawMessage("null")
+	}
+	return json.RawMessage(s.String)
+}
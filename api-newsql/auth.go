@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	scopeUsersRead  = "users:read"
+	scopeUsersWrite = "users:write"
+	scopeAdmin      = "admin"
+	scopeOperator   = "operator"
+)
+
+var knownScopes = []string{scopeUsersRead, scopeUsersWrite, scopeAdmin, scopeOperator}
+
+var errUnauthenticated = errors.New("missing credentials")
+
+// principal is the caller identified by an API key, a JWT or a session
+// token. Tenant is the tenant the credential belongs to, empty for the
+// default tenant. UserID and Session are set only for session tokens.
+type principal struct {
+	Subject string
+	Scopes  []string
+	Tenant  string
+	UserID  int64
+	Session string
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p *principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFrom(ctx context.Context) (*principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(*principal)
+	return p, ok
+}
+
+// requireScope authenticates the request with an X-API-Key header or an
+// Authorization: Bearer JWT or session token and lets it through only when
+// the caller holds scope.
+func (s *server) requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api-newsql"`)
+			writeProblem(w, r, http.StatusUnauthorized, authErrorDetail(err))
+			return
+		}
+
+		if !slices.Contains(p.Scopes, scope) {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="api-newsql", error="insufficient_scope", scope=%q`, scope))
+			writeProblem(w, r, http.StatusForbidden, fmt.Sprintf("The %q scope is required.", scope))
+			return
+		}
+
+		next(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+// authenticate identifies the caller within the tenant of the request.
+// API keys and session tokens are looked up in the tenant's own database
+// only, so no credential is valid for another tenant. A JWT must name the
+// tenant in its tenant claim.
+func (s *server) authenticate(r *http.Request) (*principal, error) {
+	t := tenantFrom(r.Context())
+
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return findAPIKeyPrincipal(t.db, t.id, key)
+	}
+
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return nil, errUnauthenticated
+	}
+	token = strings.TrimSpace(token)
+	if strings.HasPrefix(token, sessionTokenPrefix) {
+		return findSessionPrincipal(r.Context(), t, token)
+	}
+	if !s.jwt.enabled() {
+		return nil, errors.New("bearer tokens are not accepted")
+	}
+
+	claims, err := s.jwt.verify(token, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	if claims.Tenant != t.id {
+		return nil, errors.New("token is not valid for this tenant")
+	}
+
+	return &principal{Subject: claims.Subject, Scopes: claims.scopes(), Tenant: claims.Tenant}, nil
+}
+
+func authErrorDetail(err error) string {
+	switch {
+	case errors.Is(err, errUnauthenticated):
+		return "Authentication is required."
+	case errors.Is(err, errInvalidAPIKey):
+		return "The API key is invalid or has been revoked."
+	case errors.Is(err, errInvalidSession):
+		return "The session token is invalid or has expired."
+	default:
+		return "Invalid bearer token: " + err.Error()
+	}
+}
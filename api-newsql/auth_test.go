@@ -0,0 +1,131 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveScope sends a request to tenant t through requireScope(scope) and
+// returns the response. header holds the credentials of the request.
+func serveScope(s *server, t *tenant, scope string, header http.Header) *httptest.ResponseRecorder {
+	h := s.requireScope(scope, func(w http.ResponseWriter, r *http.Request) {
+		p, _ := principalFrom(r.Context())
+		w.Write([]byte(p.Subject))
+	})
+
+	req := httptest.NewRequest(http.MethodGet, "/users", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	rec := httptest.NewRecorder()
+	h(rec, req.WithContext(withTenant(req.Context(), t)))
+	return rec
+}
+
+func apiKeyHeader(key string) http.Header {
+	return http.Header{"X-Api-Key": {key}}
+}
+
+func bearerHeader(token string) http.Header {
+	return http.Header{"Authorization": {"Bearer " + token}}
+}
+
+// Missing or invalid credentials get 401, valid credentials without the
+// scope get 403, and both say why in WWW-Authenticate.
+func TestRequireScope(t *testing.T) {
+	def := newTenant("", newTestDB(t), t.TempDir())
+	secret := []byte("shared secret")
+	s := &server{jwt: &jwtVerifier{hmacSecret: secret}}
+
+	reader, err := createAPIKey(def.db, "reader", []string{scopeUsersRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := createAPIKey(def.db, "writer", []string{scopeUsersRead, scopeUsersWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := func(scope string) string {
+		return signJWT(t, "HS256", secret, map[string]any{"sub": "alice", "scope": scope, "exp": time.Now().Add(time.Hour).Unix()})
+	}
+
+	tests := []struct {
+		name    string
+		header  http.Header
+		status  int
+		subject string
+	}{
+		{"no credentials", nil, http.StatusUnauthorized, ""},
+		{"unknown API key", apiKeyHeader(apiKeyPrefix + "unknown"), http.StatusUnauthorized, ""},
+		{"basic auth", http.Header{"Authorization": {"Basic YWxpY2U6c2VjcmV0"}}, http.StatusUnauthorized, ""},
+		{"invalid JWT", bearerHeader(signJWT(t, "none", nil, map[string]any{"sub": "alice", "scope": scopeUsersWrite})), http.StatusUnauthorized, ""},
+		{"unknown session", bearerHeader(sessionTokenPrefix + "unknown"), http.StatusUnauthorized, ""},
+		{"API key without the scope", apiKeyHeader(reader.Key), http.StatusForbidden, ""},
+		{"JWT without the scope", bearerHeader(token(scopeUsersRead)), http.StatusForbidden, ""},
+		{"API key with the scope", apiKeyHeader(writer.Key), http.StatusOK, "apikey:writer"},
+		{"JWT with the scope", bearerHeader(token(scopeUsersRead + " " + scopeUsersWrite)), http.StatusOK, "alice"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := serveScope(s, def, scopeUsersWrite, tt.header)
+			if rec.Code != tt.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+
+			challenge := rec.Header().Get("WWW-Authenticate")
+			switch tt.status {
+			case http.StatusUnauthorized:
+				if challenge == "" || strings.Contains(challenge, "insufficient_scope") {
+					t.Errorf("WWW-Authenticate %q", challenge)
+				}
+			case http.StatusForbidden:
+				if !strings.Contains(challenge, `error="insufficient_scope"`) || !strings.Contains(challenge, scopeUsersWrite) {
+					t.Errorf("WWW-Authenticate %q", challenge)
+				}
+			case http.StatusOK:
+				if got := rec.Body.String(); got != tt.subject {
+					t.Errorf("subject %q, want %q", got, tt.subject)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireScopeWithoutJWT(t *testing.T) {
+	def := newTenant("", newTestDB(t), t.TempDir())
+	token := signJWT(t, "HS256", []byte("shared secret"), map[string]any{"sub": "alice", "scope": scopeUsersRead, "exp": time.Now().Add(time.Hour).Unix()})
+
+	if rec := serveScope(&server{}, def, scopeUsersRead, bearerHeader(token)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("status %d, want 401", rec.Code)
+	}
+}
+
+func TestRevokedAPIKey(t *testing.T) {
+	def := newTenant("", newTestDB(t), t.TempDir())
+	key, err := createAPIKey(def.db, "reader", []string{scopeUsersRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := serveScope(&server{}, def, scopeUsersRead, apiKeyHeader(key.Key)); rec.Code != http.StatusOK {
+		t.Fatalf("before revoking: status %d, want 200", rec.Code)
+	}
+	if err := revokeAPIKey(def.db, key.ID); err != nil {
+		t.Fatal(err)
+	}
+	rec := serveScope(&server{}, def, scopeUsersRead, apiKeyHeader(key.Key))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("after revoking: status %d, want 401", rec.Code)
+	}
+	if !strings.Contains(rec.Body.String(), "revoked") {
+		t.Errorf("body %s", rec.Body)
+	}
+	if err := revokeAPIKey(def.db, key.ID); !errors.Is(err, errAPIKeyNotFound) {
+		t.Errorf("revoking twice: got %v, want %v", err, errAPIKeyNotFound)
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const backupTimeFormat = "20060102T150405.000Z"
+
+var (
+	errBackupNotFound    = errors.New("backup not found")
+	errInvalidBackupName = errors.New("invalid backup name")
+
+	backupNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+\.db$`)
+)
+
+type backup struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// backupPath resolves name inside dir, refusing anything that could point
+// outside it.
+func backupPath(dir, name string) (string, error) {
+	if !backupNamePattern.MatchString(name) || strings.HasPrefix(name, ".") {
+		return "", errInvalidBackupName
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// createBackup writes a consistent snapshot of db into dir with VACUUM INTO,
+// which reads inside a single transaction and so never blocks writers. The
+// snapshot is written under a temporary name and renamed once complete, so
+// listBackups never shows a partial file.
+func createBackup(db *sql.DB, dir, label string) (*backup, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	name := "users-" + now.Format(backupTimeFormat)
+	if label != "" {
+		name += "-" + label
+	}
+	name += ".db"
+
+	path, err := backupPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+
+	if _, err := db.Exec("VACUUM INTO ?", tmp); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &backup{Name: name, Size: info.Size(), CreatedAt: now}, nil
+}
+
+// listBackups returns the snapshots in dir, newest first.
+func listBackups(dir string) ([]*backup, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []*backup{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	backups := []*backup{}
+	for _, e := range entries {
+		if e.IsDir() || !backupNamePattern.MatchString(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, &backup{Name: e.Name(), Size: info.Size(), CreatedAt: info.ModTime().UTC()})
+	}
+
+	slices.SortFunc(backups, func(a, b *backup) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return backups, nil
+}
+
+// restoreBackup replaces the contents of db with the snapshot name using
+// SQLite's online backup API, after saving the current database as a
+// "pre-restore" snapshot which it returns. The snapshot is first copied,
+// migrated to the current schema and given the current credentials (see
+// keepCredentials), and only that copy is restored, as one write
+// transaction on db: other connections see either the old or the restored
+// database, never a mix, and never the credentials of the snapshot. The
+// user_events sequence is kept past its previous value so that event IDs
+// stay monotonic for change feed subscribers.
+func restoreBackup(ctx context.Context, db *sql.DB, dir, name string) (*backup, error) {
+	path, err := backupPath(dir, name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+		return nil, errBackupNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := sql.Open("sqlite3", sqliteDSN(path, "mode=ro"))
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Close()
+
+	var check string
+	if err := snapshot.QueryRowContext(ctx, "PRAGMA quick_check").Scan(&check); err != nil {
+		return nil, fmt.Errorf("checking backup %s: %w", name, err)
+	}
+	if check != "ok" {
+		return nil, fmt.Errorf("backup %s is corrupt: %s", name, check)
+	}
+
+	safety, err := createBackup(db, dir, "pre-restore")
+	if err != nil {
+		return nil, err
+	}
+
+	// The working copy does not match backupNamePattern, so listBackups
+	// never shows it.
+	workPath := path + ".restore.tmp"
+	defer os.Remove(workPath)
+	if _, err := snapshot.ExecContext(ctx, "VACUUM INTO ?", workPath); err != nil {
+		return nil, fmt.Errorf("copying backup %s: %w", name, err)
+	}
+	src, err := sql.Open("sqlite3", sqliteDSN(workPath, "_foreign_keys=on"))
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	// A single connection keeps the database attached by keepCredentials.
+	src.SetMaxOpenConns(1)
+
+	if err := migrateUp(src); err != nil {
+		return nil, err
+	}
+	if err := keepCredentials(ctx, src, filepath.Join(dir, safety.Name)); err != nil {
+		return nil, fmt.Errorf("restoring backup %s: %w", name, err)
+	}
+
+	var lastEventID int64
+	if err := db.QueryRowContext(ctx, "SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'user_events'").Scan(&lastEventID); err != nil {
+		return nil, err
+	}
+
+	srcConn, err := src.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer srcConn.Close()
+
+	dstConn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer dstConn.Close()
+
+	err = dstConn.Raw(func(dst any) error {
+		return srcConn.Raw(func(src any) error {
+			b, err := dst.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			if _, err := b.Step(-1); err != nil {
+				b.Finish()
+				return err
+			}
+			return b.Finish()
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restoring backup %s: %w", name, err)
+	}
+
+	_, err = db.ExecContext(ctx, "UPDATE sqlite_sequence SET seq = MAX(seq, ?) WHERE name = 'user_events'", lastEventID)
+	if err != nil {
+		return nil, err
+	}
+	return safety, nil
+}
+
+// keepCredentials replaces the credentials in db, a snapshot being
+// restored, with those of the database saved at currentPath just before the
+// restore: API keys, sessions, password reset tokens and password hashes.
+// A restore brings back users and their history, but a key revoked, a
+// session ended or a password changed since the snapshot must stay so.
+// Users the snapshot has and the current database does not are left
+// without a password.
+func keepCredentials(ctx context.Context, db *sql.DB, currentPath string) error {
+	if _, err := db.ExecContext(ctx, "ATTACH DATABASE ? AS current", sqliteDSN(currentPath, "mode=ro")); err != nil {
+		return err
+	}
+	defer db.Exec("DETACH DATABASE current")
+
+	return runInTx(ctx, db, func(tx *sql.Tx) error {
+		for _, stmt := range []string{
+			"DELETE FROM main.api_keys",
+			`INSERT INTO main.api_keys (id, name, prefix, key_hash, scopes, created_at, revoked_at)
+				SELECT id, name, prefix, key_hash, scopes, created_at, revoked_at FROM current.api_keys`,
+			"DELETE FROM main.sessions",
+			`INSERT INTO main.sessions (token_hash, user_id, created_at, expires_at)
+				SELECT token_hash, user_id, created_at, expires_at FROM current.sessions
+				WHERE user_id IN (SELECT id FROM main.users)`,
+			"DELETE FROM main.password_resets",
+			`INSERT INTO main.password_resets (token_hash, user_id, created_at, expires_at, used_at)
+				SELECT token_hash, user_id, created_at, expires_at, used_at FROM current.password_resets
+				WHERE user_id IN (SELECT id FROM main.users)`,
+			`UPDATE main.users SET password_hash = c.password_hash, failed_logins = c.failed_logins, locked_until = c.locked_until
+				FROM current.users AS c WHERE c.id = users.id`,
+			`UPDATE main.users SET password_hash = NULL, failed_logins = 0, locked_until = NULL
+				WHERE id NOT IN (SELECT id FROM current.users)`,
+		} {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// quiesce holds off restores while a write request runs, and refuses the
+// write once the tenant is being deprovisioned. Every route that writes to
+// the database goes through it.
+func (s *server) quiesce(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		t := tenantFrom(r.Context())
+		t.writes.RLock()
+		defer t.writes.RUnlock()
+		if t.deleted {
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Tenant %q not found", t.id))
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *server) createBackupHandler(w http.ResponseWriter, r *http.Request) {
+	t := tenantFrom(r.Context())
+	b, err := createBackup(t.db, t.backupDir, "")
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, b)
+}
+
+func (s *server) listBackupsHandler(w http.ResponseWriter, r *http.Request) {
+	backups, err := listBackups(tenantFrom(r.Context()).backupDir)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"data": backups})
+}
+
+// restoreBackupHandler waits for in-flight writes to finish and blocks new
+// ones until the restore is done.
+func (s *server) restoreBackupHandler(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+
+	t := tenantFrom(r.Context())
+	t.writes.Lock()
+	defer t.writes.Unlock()
+	if t.deleted {
+		writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Tenant %q not found", t.id))
+		return
+	}
+
+	safety, err := restoreBackup(r.Context(), t.db, t.backupDir, name)
+	if errors.Is(err, errInvalidBackupName) {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid backup name")
+		return
+	} else if errors.Is(err, errBackupNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Backup not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"restored": name, "previous": safety})
+}
+
+// runBackupCommand implements "backup create", "backup list" and
+// "backup restore NAME". Restoring from the command line does not coordinate
+// with a running server; stop it first or use the admin endpoint.
+func runBackupCommand(db *sql.DB, dir string, args []string, w io.Writer) error {
+	usage := errors.New("usage: backup create | list | restore NAME")
+	if len(args) == 0 {
+		return usage
+	}
+
+	switch args[0] {
+	case "create":
+		if len(args) != 1 {
+			return usage
+		}
+		b, err := createBackup(db, dir, "")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Created backup %s (%d bytes)\n", filepath.Join(dir, b.Name), b.Size)
+		return nil
+	case "list":
+		backups, err := listBackups(dir)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tCREATED AT")
+		for _, b := range backups {
+			fmt.Fprintf(tw, "%s\t%d\t%s\n", b.Name, b.Size, b.CreatedAt.Format(time.RFC3339))
+		}
+		return tw.Flush()
+	case "restore":
+		if len(args) != 2 {
+			return usage
+		}
+		safety, err := restoreBackup(context.Background(), db, dir, args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "Restored %s; the previous database was saved as %s\n", args[1], safety.Name)
+		return nil
+	default:
+		return usage
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// A backup directory whose name has characters with a meaning in a URI
+// still restores the right file, read-only.
+func TestRestoreBackupEscapesPath(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	repo := newSQLiteUserRepository(db, newEventBroker())
+	dir := filepath.Join(t.TempDir(), "backups?mode=rwc#1")
+
+	mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	b, err := createBackup(db, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, ctx, repo, "Bob", "bob@example.com")
+
+	if _, err := restoreBackup(ctx, db, dir, b.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.GetByEmail(ctx, "alice@example.com"); err != nil {
+		t.Errorf("alice@example.com after restore: %v", err)
+	}
+	if _, err := repo.GetByEmail(ctx, "bob@example.com"); err == nil {
+		t.Error("bob@example.com, created after the backup, survived the restore")
+	}
+}
+
+// A restore brings back the users of the snapshot but keeps the credentials
+// as they were just before it: a key revoked or a session ended since the
+// snapshot stays so, and newer keys, sessions and passwords still work.
+func TestRestoreBackupKeepsCredentials(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	repo := newSQLiteUserRepository(db, newEventBroker())
+	dir := t.TempDir()
+	now := time.Now().UTC()
+
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	if err := repo.SetPassword(ctx, alice.ID, mustHashPassword("old password")); err != nil {
+		t.Fatal(err)
+	}
+	leaked, err := createAPIKey(db, "leaked", []string{scopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateSession(ctx, alice.ID, hashToken("old session"), now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreatePasswordReset(ctx, alice.ID, hashToken("old reset"), now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := createBackup(db, dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// After the snapshot the leaked key is revoked and Alice changes her
+	// password, which ends her old session, and asks for a new reset token.
+	if err := revokeAPIKey(db, leaked.ID); err != nil {
+		t.Fatal(err)
+	}
+	current, err := createAPIKey(db, "current", []string{scopeAdmin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	newHash := mustHashPassword("new password")
+	if err := repo.SetPassword(ctx, alice.ID, newHash); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateSession(ctx, alice.ID, hashToken("new session"), now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.CreatePasswordReset(ctx, alice.ID, hashToken("new reset"), now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	bob := mustCreate(t, ctx, repo, "Bob", "bob@example.com")
+	if _, err := repo.CreateSession(ctx, bob.ID, hashToken("bob session"), now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := restoreBackup(ctx, db, dir, b.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := repo.GetByEmail(ctx, "bob@example.com"); err == nil {
+		t.Error("bob@example.com, created after the backup, survived the restore")
+	}
+	if _, err := findAPIKeyPrincipal(db, "", leaked.Key); !errors.Is(err, errInvalidAPIKey) {
+		t.Errorf("revoked key after restore: got %v, want %v", err, errInvalidAPIKey)
+	}
+	if _, err := findAPIKeyPrincipal(db, "", current.Key); err != nil {
+		t.Errorf("key created after the backup: %v", err)
+	}
+	if hash, err := repo.PasswordHash(ctx, alice.ID); err != nil || hash != newHash {
+		t.Errorf("Alice's password was restored too: %v", err)
+	}
+	for token, valid := range map[string]bool{"old session": false, "new session": true, "bob session": false} {
+		if _, err := repo.FindSession(ctx, hashToken(token), now); (err == nil) != valid {
+			t.Errorf("%s after restore: %v, want valid = %t", token, err, valid)
+		}
+	}
+	if err := repo.ResetPassword(ctx, hashToken("old reset"), newHash, now); !errors.Is(err, errInvalidResetToken) {
+		t.Errorf("old reset token after restore: got %v, want %v", err, errInvalidResetToken)
+	}
+	if err := repo.ResetPassword(ctx, hashToken("new reset"), newHash, now); err != nil {
+		t.Errorf("new reset token after restore: %v", err)
+	}
+}
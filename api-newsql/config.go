@@ -0,0 +1,67 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Defaults for the HTTP server. Every one can be overridden by a flag or by
+// the environment variable named next to it, the flag taking precedence.
+const (
+	defaultAddr              = ":8082"           // ADDR
+	defaultReadHeaderTimeout = 5 * time.Second   // READ_HEADER_TIMEOUT
+	defaultReadTimeout       = 30 * time.Second  // READ_TIMEOUT
+	defaultWriteTimeout      = 30 * time.Second  // WRITE_TIMEOUT
+	defaultIdleTimeout       = 120 * time.Second // IDLE_TIMEOUT
+	defaultShutdownTimeout   = 20 * time.Second  // SHUTDOWN_TIMEOUT
+	defaultBackupDir         = "backups"         // BACKUP_DIR
+	defaultMaxOpenTenants    = 32                // MAX_OPEN_TENANTS
+)
+
+func envString(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func envInt(name string, def int) int {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return n
+}
+
+func envBool(name string, def bool) bool {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return b
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok || v == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", name, v, err)
+	}
+	return d
+}
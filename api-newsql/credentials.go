@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	sessionTokenPrefix = "nss_"
+	resetTokenPrefix   = "nsr_"
+
+	sessionTTL    = 24 * time.Hour
+	resetTokenTTL = time.Hour
+
+	maxFailedLogins = 5
+	lockoutDuration = 15 * time.Minute
+)
+
+// sessionScopes are granted to every session token. Sessions belong to end
+// users, who may read the directory but only change their own password.
+var sessionScopes = []string{scopeUsersRead}
+
+var (
+	errInvalidSession    = errors.New("invalid session")
+	errInvalidResetToken = errors.New("invalid reset token")
+)
+
+// newToken returns a random secret with the given prefix, used for API keys,
+// session tokens and password reset tokens alike.
+func newToken(prefix string) (string, error) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return prefix + base64.RawURLEncoding.EncodeToString(secret), nil
+}
+
+// hashToken returns the SHA-256 of a token. Only these hashes are stored, so
+// a leaked database does not leak usable credentials.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+type loginRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type loginResponse struct {
+	Token     string    `json:"token"`
+	TokenType string    `json:"token_type"`
+	ExpiresAt time.Time `json:"expires_at"`
+	User      *user     `json:"user"`
+}
+
+type changePasswordRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type setPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+type passwordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type passwordResetConfirmRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+func findSessionPrincipal(ctx context.Context, t *tenant, token string) (*principal, error) {
+	hash := hashToken(token)
+
+	userID, err := t.users.FindSession(ctx, hash, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+
+	return &principal{
+		Subject: fmt.Sprintf("user:%d", userID),
+		Scopes:  sessionScopes,
+		Tenant:  t.id,
+		UserID:  userID,
+		Session: hash,
+	}, nil
+}
+
+// requireSession lets the request through only when it is authenticated
+// with a session token from POST /auth/login.
+func (s *server) requireSession(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, err := s.authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="api-newsql"`)
+			writeProblem(w, r, http.StatusUnauthorized, authErrorDetail(err))
+			return
+		}
+		if p.UserID == 0 {
+			writeProblem(w, r, http.StatusForbidden, "This route requires a session token from POST /auth/login.")
+			return
+		}
+
+		next(w, r.WithContext(withPrincipal(r.Context(), p)))
+	}
+}
+
+// loginHandler exchanges an email and password for a session token. After
+// maxFailedLogins wrong passwords in a row the account is locked for
+// lockoutDuration. Unknown emails, users without a password, locked users
+// and wrong passwords get the same answer, and take about as long, so the
+// endpoint does not reveal which emails exist.
+func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	var errs []fieldError
+	if req.Email == "" {
+		errs = append(errs, fieldError{Field: "email", Message: "is required"})
+	}
+	if req.Password == "" {
+		errs = append(errs, fieldError{Field: "password", Message: "is required"})
+	}
+	if len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	now := time.Now().UTC()
+
+	st, err := usersFor(r).LoginState(r.Context(), req.Email)
+	if errors.Is(err, errUserNotFound) {
+		st = &loginState{}
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// A locked account answers like an unknown email, or the lockout would
+	// tell which emails exist; only the log says why.
+	if st.LockedUntil != nil && st.LockedUntil.After(now) {
+		verifyPassword(dummyPasswordHash(), req.Password)
+		log.Printf("login: user %d is locked until %s", st.UserID, st.LockedUntil.Format(time.RFC3339))
+		writeProblem(w, r, http.StatusUnauthorized, "Invalid email or password.")
+		return
+	}
+
+	if st.PasswordHash == "" {
+		verifyPassword(dummyPasswordHash(), req.Password)
+		writeProblem(w, r, http.StatusUnauthorized, "Invalid email or password.")
+		return
+	}
+
+	ok, err := verifyPassword(st.PasswordHash, req.Password)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if !ok {
+		// The lock starts on the failure that reaches the limit, and the
+		// counter starts over once it expires.
+		if err := usersFor(r).RecordFailedLogin(r.Context(), st.UserID, maxFailedLogins, now.Add(lockoutDuration)); err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		writeProblem(w, r, http.StatusUnauthorized, "Invalid email or password.")
+		return
+	}
+
+	token, err := newToken(sessionTokenPrefix)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	resp := loginResponse{Token: token, TokenType: "Bearer", ExpiresAt: now.Add(sessionTTL)}
+
+	resp.User, err = usersFor(r).CreateSession(r.Context(), st.UserID, hashToken(token), now, resp.ExpiresAt)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+	if err := usersFor(r).DeleteSession(r.Context(), p.Session); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changePasswordHandler lets a logged-in user replace their password. Every
+// other session of the user is ended.
+func (s *server) changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	p, _ := principalFrom(r.Context())
+
+	var req changePasswordRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errs := appendIf(nil, "new_password", validatePassword(req.NewPassword)); len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	current, err := usersFor(r).PasswordHash(r.Context(), p.UserID)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if current != "" {
+		ok, err := verifyPassword(current, req.CurrentPassword)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		if !ok {
+			writeValidationProblem(w, r, []fieldError{{Field: "current_password", Message: "is incorrect"}})
+			return
+		}
+	}
+
+	hash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if err := usersFor(r).ChangePassword(r.Context(), p.UserID, hash, p.Session); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setPasswordHandler sets the password of any user. It is meant for
+// provisioning accounts, so it also clears a lockout and ends the user's
+// sessions.
+func (s *server) setPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var req setPasswordRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errs := appendIf(nil, "password", validatePassword(req.Password)); len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if err := usersFor(r).SetPassword(r.Context(), id, hash); err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestPasswordResetHandler issues a reset token valid for resetTokenTTL.
+// It always answers 202 so that it cannot be used to find out which emails
+// are registered.
+func (s *server) requestPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	req.Email = strings.TrimSpace(req.Email)
+	if errs := appendIf(nil, "email", validateEmail(req.Email)); len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	u, err := usersFor(r).GetByEmail(r.Context(), req.Email)
+	if errors.Is(err, errUserNotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	token, err := newToken(resetTokenPrefix)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	now := time.Now().UTC()
+	expiresAt := now.Add(resetTokenTTL)
+
+	// Only the newest token is valid.
+	if err := usersFor(r).CreatePasswordReset(r.Context(), u.ID, hashToken(token), now, expiresAt); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// The answer stays 202 when delivery fails, for the same reason.
+	if err := s.resets.SendPasswordReset(r.Context(), u, token, expiresAt); err != nil {
+		log.Printf("sending password reset to user %d: %v", u.ID, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// passwordResetSender delivers a reset token to its user, typically as a
+// link by email.
+type passwordResetSender interface {
+	SendPasswordReset(ctx context.Context, u *user, token string, expiresAt time.Time) error
+}
+
+// logResetSender is the sender used while the service has no mail
+// transport. It only logs that a reset was requested; the token itself is
+// logged only when logTokens is set, which is meant for local development.
+type logResetSender struct {
+	logTokens bool
+}
+
+func (l logResetSender) SendPasswordReset(ctx context.Context, u *user, token string, expiresAt time.Time) error {
+	if !l.logTokens {
+		log.Printf("password reset requested for user %d; no sender is configured, so the token was not delivered", u.ID)
+		return nil
+	}
+	log.Printf("password reset for user %d <%s>: token %s, valid until %s", u.ID, u.Email, token, expiresAt.Format(time.RFC3339))
+	return nil
+}
+
+// confirmPasswordResetHandler sets a new password with a reset token. The
+// token can be used once; the lockout is cleared and all sessions end.
+func (s *server) confirmPasswordResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req passwordResetConfirmRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if errs := appendIf(nil, "password", validatePassword(req.Password)); len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	err = usersFor(r).ResetPassword(r.Context(), hashToken(req.Token), hash, time.Now().UTC())
+	if errors.Is(err, errInvalidResetToken) {
+		writeProblem(w, r, http.StatusBadRequest, "The reset token is invalid or has expired.")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A locked account, an unknown email and a wrong password must be
+// indistinguishable, or the login would tell which emails exist.
+func TestLoginFailuresLookTheSame(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryUserRepository(newEventBroker())
+
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	bob := mustCreate(t, ctx, repo, "Bob", "bob@example.com")
+	hash := mustHashPassword("correct horse battery")
+	for _, u := range []*user{alice, bob} {
+		if err := repo.SetPassword(ctx, u.ID, hash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for range maxFailedLogins {
+		if err := repo.RecordFailedLogin(ctx, bob.ID, maxFailedLogins, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	login := func(email, password string) (int, string) {
+		t.Helper()
+		body := `{"email": "` + email + `", "password": "` + password + `"}`
+		rec := serveUsers(repo, (&server{}).loginHandler, http.MethodPost, "/auth/login", "application/json", strings.NewReader(body))
+		return rec.Code, rec.Body.String()
+	}
+
+	wantStatus, wantBody := login("nobody@example.com", "correct horse battery")
+	if wantStatus != http.StatusUnauthorized {
+		t.Fatalf("unknown email: status %d, want 401", wantStatus)
+	}
+	for name, creds := range map[string][2]string{
+		"wrong password": {"alice@example.com", "wrong password"},
+		"locked account": {"bob@example.com", "correct horse battery"},
+	} {
+		if status, body := login(creds[0], creds[1]); status != wantStatus || body != wantBody {
+			t.Errorf("%s: got %d %s, want %d %s", name, status, body, wantStatus, wantBody)
+		}
+	}
+}
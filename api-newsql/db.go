@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	maxOpenConns    = 8
+	maxIdleConns    = 8
+	connMaxIdleTime = 5 * time.Minute
+)
+
+// openDB opens the shared connection pool used by every handler. WAL lets
+// readers proceed while a writer holds the lock, the busy timeout makes
+// concurrent writers wait instead of failing with SQLITE_BUSY, and
+// immediate transactions avoid deadlocks when a read transaction later
+// tries to write.
+func openDB(path string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite3", sqliteDSN(path, "_journal_mode=WAL&_synchronous=NORMAL&_busy_timeout=5000&_foreign_keys=on&_txlock=immediate"))
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxIdleConns)
+	db.SetConnMaxIdleTime(connMaxIdleTime)
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+
+	return db, nil
+}
+
+// sqliteDSN builds the "file:" URI of the database at path. The path is
+// escaped, as "?", "#" and "%" would otherwise start the query or the
+// fragment or be decoded; SQLite decodes it again when opening the file.
+func sqliteDSN(path, query string) string {
+	return "file:" + strings.ReplaceAll(url.PathEscape(path), "%2F", "/") + "?" + query
+}
+
+func runInTx(ctx context.Context, db *sql.DB, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// isUniqueViolation reports whether err comes from a UNIQUE or PRIMARY KEY
+// constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr sqlite3.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.ExtendedCode == sqlite3.ErrConstraintUnique || sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Characters with a meaning in a URI are part of the file name.
+func TestOpenDBEscapesPath(t *testing.T) {
+	for _, name := range []string{"a?mode=ro.db", "a#b.db", "100%.db", "with space.db"} {
+		path := filepath.Join(t.TempDir(), name)
+		db, err := openDB(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		_, err = db.Exec("CREATE TABLE t (x INTEGER)")
+		db.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s: database file was not created: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+func userETag(version int64) string {
+	return fmt.Sprintf(`"%d"`, version)
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists etag
+// or "*". If-Match requires the strong comparison of RFC 9110, while
+// If-None-Match uses the weak one and ignores the W/ prefix.
+func etagMatches(header, etag string, weak bool) bool {
+	for _, part := range strings.Split(header, ",") {
+		tag := strings.TrimSpace(part)
+		if tag == "*" {
+			return true
+		}
+		if strings.HasPrefix(tag, "W/") {
+			if !weak {
+				continue
+			}
+			tag = strings.TrimPrefix(tag, "W/")
+		}
+		if tag == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventUserCreated = "user.created"
+	eventUserUpdated = "user.updated"
+	eventUserDeleted = "user.deleted"
+
+	eventBatchSize = 100
+
+	// eventPollInterval bounds how long a subscriber can miss a write made
+	// outside this process, which does not go through eventBroker.
+	eventPollInterval = 5 * time.Second
+	eventKeepAlive    = 15 * time.Second
+	eventRetry        = 3 * time.Second
+)
+
+type userEvent struct {
+	ID   int64
+	Type string
+	Data string
+}
+
+// eventBroker wakes the change feed subscribers after a write commits. It
+// carries no data; subscribers read the new events from the repository.
+type eventBroker struct {
+	mu     sync.Mutex
+	ch     chan struct{}
+	closed chan struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{ch: make(chan struct{}), closed: make(chan struct{})}
+}
+
+// wait returns a channel that is closed on the next notify.
+func (b *eventBroker) wait() <-chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ch
+}
+
+func (b *eventBroker) notify() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	close(b.ch)
+	b.ch = make(chan struct{})
+}
+
+// close ends every open stream so that server shutdown does not wait for
+// subscribers that would never disconnect on their own.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.closed:
+	default:
+		close(b.closed)
+	}
+}
+
+// userEventsHandler streams user changes as server-sent events. A client
+// resumes after the last event it saw with the Last-Event-ID header, or the
+// last_event_id query parameter for the first connection; without either the
+// stream starts with the next change.
+func (s *server) userEventsHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	t := tenantFrom(r.Context())
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+
+	var lastID int64
+	var err error
+	if lastEventID != "" {
+		lastID, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || lastID < 0 {
+			writeProblem(w, r, http.StatusBadRequest, "Last-Event-ID must be a non-negative event ID")
+			return
+		}
+	} else if lastID, err = t.users.LastEventID(r.Context()); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	// The stream stays open until the client leaves, so the server's write
+	// timeout does not apply.
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", eventRetry.Milliseconds())
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	poll := time.NewTicker(eventPollInterval)
+	defer poll.Stop()
+	keepAlive := time.NewTicker(eventKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		// Take the wake-up channel before reading so that a commit landing
+		// between the read and the wait is not missed.
+		wake := t.events.wait()
+
+		events, err := t.users.Events(r.Context(), lastID, eventBatchSize)
+		if err != nil {
+			// Headers are already sent; the client reconnects with the
+			// last ID it received.
+			log.Printf("streaming user events: %v", err)
+			return
+		}
+		for _, e := range events {
+			fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, e.Data)
+			lastID = e.ID
+		}
+		if len(events) > 0 {
+			if err := rc.Flush(); err != nil {
+				return
+			}
+			keepAlive.Reset(eventKeepAlive)
+		}
+		if len(events) == eventBatchSize {
+			continue
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-t.events.closed:
+			return
+		case <-wake:
+		case <-poll.C:
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sseEvent is one event read from a server-sent event stream.
+type sseEvent struct {
+	ID   string
+	Type string
+	Data string
+}
+
+// serveEvents serves the change feed of tenant t. The returned channel is
+// closed once the handler of every stream has returned.
+func serveEvents(t *testing.T, ten *tenant) (*httptest.Server, <-chan struct{}) {
+	t.Helper()
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		(&server{}).userEventsHandler(w, r.WithContext(withTenant(r.Context(), ten)))
+		close(done)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, done
+}
+
+// openEvents connects to the change feed and returns a function reading the
+// next event, which fails the test when the stream ends first.
+func openEvents(t *testing.T, ctx context.Context, url, lastEventID string) (*http.Response, func() sseEvent) {
+	t.Helper()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	lines := bufio.NewScanner(resp.Body)
+	next := func() sseEvent {
+		t.Helper()
+		var e sseEvent
+		for lines.Scan() {
+			field, value, _ := strings.Cut(lines.Text(), ": ")
+			switch field {
+			case "id":
+				e.ID = value
+			case "event":
+				e.Type = value
+			case "data":
+				e.Data = value
+			case "":
+				if e.ID != "" {
+					return e
+				}
+			}
+		}
+		t.Fatalf("stream ended: %v", lines.Err())
+		return e
+	}
+	return resp, next
+}
+
+func waitClosed(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not return", what)
+	}
+}
+
+// A client resuming with Last-Event-ID gets exactly the events it missed,
+// then the live ones, and the handler returns once the client leaves.
+func TestUserEventsResume(t *testing.T) {
+	ctx := context.Background()
+	ten := newTenant("", newTestDB(t), t.TempDir())
+	srv, done := serveEvents(t, ten)
+
+	mustCreate(t, ctx, ten.users, "Alice", "alice@example.com")
+	seen, err := ten.users.LastEventID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob := mustCreate(t, ctx, ten.users, "Bob", "bob@example.com")
+	if err := ten.users.Delete(ctx, bob.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	clientCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	_, next := openEvents(t, clientCtx, srv.URL, strconv.FormatInt(seen, 10))
+
+	for _, want := range []string{eventUserCreated, eventUserDeleted} {
+		e := next()
+		if e.Type != want || !strings.Contains(e.Data, "bob@example.com") {
+			t.Fatalf("missed event: got %+v, want %s of Bob", e, want)
+		}
+		if id, _ := strconv.ParseInt(e.ID, 10, 64); id <= seen {
+			t.Fatalf("event %s replayed, the client had seen %d", e.ID, seen)
+		}
+	}
+
+	mustCreate(t, ctx, ten.users, "Carol", "carol@example.com")
+	if e := next(); e.Type != eventUserCreated || !strings.Contains(e.Data, "carol@example.com") {
+		t.Fatalf("live event: got %+v, want %s of Carol", e, eventUserCreated)
+	}
+
+	cancel()
+	waitClosed(t, done, "the handler of a cancelled request")
+}
+
+// Shutdown ends open streams, which would otherwise keep the server waiting
+// for clients that never disconnect.
+func TestUserEventsShutdown(t *testing.T) {
+	p := newTestTenantPool(t)
+	srv, done := serveEvents(t, p.def)
+
+	resp, _ := openEvents(t, context.Background(), srv.URL, "")
+	p.closeStreams()
+
+	waitClosed(t, done, "the stream handler")
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		t.Errorf("reading the closed stream: %v", err)
+	}
+}
+
+func TestUserEventsBadLastEventID(t *testing.T) {
+	repo := newMemoryUserRepository(newEventBroker())
+	for _, target := range []string{"/users/events?last_event_id=x", "/users/events?last_event_id=-1"} {
+		if rec := serveUsers(repo, (&server{}).userEventsHandler, http.MethodGet, target, "", nil); rec.Code != http.StatusBadRequest {
+			t.Errorf("GET %s: status %d, want 400", target, rec.Code)
+		}
+	}
+}
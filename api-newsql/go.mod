@@ -1,5 +1,11 @@
 module api-newsql
 
-go 1.18
+go 1.22
 
-require github.com/mattn/go-sqlite3 v1.14.22
+require (
+	github.com/graphql-go/graphql v0.8.1
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/crypto v0.31.0
+)
+
+require golang.org/x/sys v0.28.0 // indirect
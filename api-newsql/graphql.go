@@ -0,0 +1,505 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/graphql-go/graphql"
+	"github.com/graphql-go/graphql/gqlerrors"
+	"github.com/graphql-go/graphql/language/ast"
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// Limits on a GraphQL document, checked before it runs. Every field costs
+// one and the selections under users cost as much again per requested
+// user, so a single query cannot walk the whole table several times over.
+const (
+	graphQLMaxDepth      = 12
+	graphQLMaxComplexity = 2000
+)
+
+// graphQLRequest is the body of POST /graphql.
+type graphQLRequest struct {
+	Query         string         `json:"query"`
+	Variables     map[string]any `json:"variables"`
+	OperationName string         `json:"operationName"`
+}
+
+// graphQLError is a resolver error with a machine-readable code in its
+// extensions, the GraphQL counterpart of the problem responses.
+type graphQLError struct {
+	code    string
+	message string
+	errs    []fieldError
+}
+
+func (e *graphQLError) Error() string { return e.message }
+
+func (e *graphQLError) Extensions() map[string]any {
+	ext := map[string]any{"code": e.code}
+	if len(e.errs) > 0 {
+		ext["errors"] = e.errs
+	}
+	return ext
+}
+
+// graphQLUserError translates a repository error the same way
+// writeUserError does for REST responses.
+func graphQLUserError(err error) error {
+	var validationErr *validationError
+	switch {
+	case errors.As(err, &validationErr):
+		return &graphQLError{code: "VALIDATION_FAILED", message: "One or more fields are invalid.", errs: validationErr.errs}
+	case errors.Is(err, errUserNotFound):
+		return &graphQLError{code: "NOT_FOUND", message: "User not found"}
+	case errors.Is(err, errPreconditionFailed):
+		return &graphQLError{code: "PRECONDITION_FAILED", message: "The user was modified since it was last read."}
+	case errors.Is(err, errEmailTaken):
+		return &graphQLError{code: "CONFLICT", message: "A user with this email already exists."}
+	default:
+		log.Printf("graphql: %v", err)
+		return &graphQLError{code: "INTERNAL", message: "An unexpected error occurred."}
+	}
+}
+
+type userConnection struct {
+	Edges      []userEdge `json:"edges"`
+	PageInfo   pageInfo   `json:"pageInfo"`
+	TotalCount int64      `json:"totalCount"`
+}
+
+type userEdge struct {
+	Cursor string `json:"cursor"`
+	Node   *user  `json:"node"`
+}
+
+type pageInfo struct {
+	HasNextPage bool    `json:"hasNextPage"`
+	EndCursor   *string `json:"endCursor"`
+}
+
+func newGraphQLSchema() (graphql.Schema, error) {
+	userType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "User",
+		Fields: graphql.Fields{
+			"id":    &graphql.Field{Type: graphql.NewNonNull(graphql.ID)},
+			"name":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"email": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"deletedAt": &graphql.Field{
+				Type: graphql.String,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					if u := p.Source.(*user); u.DeletedAt != nil {
+						return u.DeletedAt.UTC().Format(time.RFC3339Nano), nil
+					}
+					return nil, nil
+				},
+			},
+			"version": &graphql.Field{
+				Type:        graphql.NewNonNull(graphql.Int),
+				Description: "Changes on every write; pass it as expectedVersion to update or delete only an unchanged user.",
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					return p.Source.(*user).Version, nil
+				},
+			},
+		},
+	})
+
+	connectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UserConnection",
+		Fields: graphql.Fields{
+			"edges": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
+				Name: "UserEdge",
+				Fields: graphql.Fields{
+					"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+					"node":   &graphql.Field{Type: graphql.NewNonNull(userType)},
+				},
+			}))))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
+				Name: "PageInfo",
+				Fields: graphql.Fields{
+					"hasNextPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+					"endCursor":   &graphql.Field{Type: graphql.String},
+				},
+			}))},
+			"totalCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	filterType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UserFilter",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":           &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Name prefix, ignoring case."},
+			"email":          &graphql.InputObjectFieldConfig{Type: graphql.String, Description: "Email prefix, ignoring case."},
+			"includeDeleted": &graphql.InputObjectFieldConfig{Type: graphql.Boolean, DefaultValue: false},
+		},
+	})
+
+	createInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CreateUserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":  &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"email": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	updateInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "UpdateUserInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"name":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"email": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+
+	query := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Query",
+		Fields: graphql.Fields{
+			"user": &graphql.Field{
+				Type: userType,
+				Args: graphql.FieldConfigArgument{
+					"id":             &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"includeDeleted": &graphql.ArgumentConfig{Type: graphql.Boolean, DefaultValue: false},
+				},
+				Resolve: resolveUser,
+			},
+			"users": &graphql.Field{
+				Type: graphql.NewNonNull(connectionType),
+				Args: graphql.FieldConfigArgument{
+					"filter": &graphql.ArgumentConfig{Type: filterType},
+					"first":  &graphql.ArgumentConfig{Type: graphql.Int, DefaultValue: defaultPageSize},
+					"after":  &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: resolveUsers,
+			},
+		},
+	})
+
+	mutation := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Mutation",
+		Fields: graphql.Fields{
+			"createUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"input": &graphql.ArgumentConfig{Type: graphql.NewNonNull(createInput)},
+				},
+				Resolve: requireWriteScope(resolveCreateUser),
+			},
+			"updateUser": &graphql.Field{
+				Type: graphql.NewNonNull(userType),
+				Args: graphql.FieldConfigArgument{
+					"id":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"input":           &graphql.ArgumentConfig{Type: graphql.NewNonNull(updateInput)},
+					"expectedVersion": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: requireWriteScope(resolveUpdateUser),
+			},
+			"deleteUser": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"id":              &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.ID)},
+					"expectedVersion": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: requireWriteScope(resolveDeleteUser),
+			},
+		},
+	})
+
+	return graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
+}
+
+// requireWriteScope guards a mutation the way requireScope guards the REST
+// write routes; the endpoint itself only requires users:read.
+func requireWriteScope(resolve graphql.FieldResolveFn) graphql.FieldResolveFn {
+	return func(p graphql.ResolveParams) (any, error) {
+		if pr, ok := principalFrom(p.Context); !ok || !slices.Contains(pr.Scopes, scopeUsersWrite) {
+			return nil, &graphQLError{code: "FORBIDDEN", message: fmt.Sprintf("The %q scope is required.", scopeUsersWrite)}
+		}
+		return resolve(p)
+	}
+}
+
+func graphQLUserID(p graphql.ResolveParams) (int64, error) {
+	id, err := strconv.ParseInt(fmt.Sprint(p.Args["id"]), 10, 64)
+	if err != nil {
+		return 0, &graphQLError{code: "BAD_USER_INPUT", message: "Invalid user ID"}
+	}
+	return id, nil
+}
+
+// graphQLIfMatch turns the optional expectedVersion argument into the
+// If-Match value the repository checks.
+func graphQLIfMatch(p graphql.ResolveParams) string {
+	if v, ok := p.Args["expectedVersion"].(int); ok {
+		return userETag(int64(v))
+	}
+	return ""
+}
+
+func resolveUser(p graphql.ResolveParams) (any, error) {
+	id, err := graphQLUserID(p)
+	if err != nil {
+		return nil, err
+	}
+
+	includeDeleted, _ := p.Args["includeDeleted"].(bool)
+	u, err := tenantFrom(p.Context).users.Get(p.Context, id, includeDeleted)
+	if errors.Is(err, errUserNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, graphQLUserError(err)
+	}
+	return u, nil
+}
+
+func resolveUsers(p graphql.ResolveParams) (any, error) {
+	first, _ := p.Args["first"].(int)
+	if first < 1 || first > maxPageSize {
+		return nil, &graphQLError{code: "BAD_USER_INPUT", message: fmt.Sprintf("first must be between 1 and %d", maxPageSize)}
+	}
+
+	q := url.Values{"limit": {strconv.Itoa(first)}}
+	if after, ok := p.Args["after"].(string); ok && after != "" {
+		q.Set("cursor", after)
+	}
+	if filter, ok := p.Args["filter"].(map[string]any); ok {
+		if v, ok := filter["name"].(string); ok {
+			q.Set("name", v)
+		}
+		if v, ok := filter["email"].(string); ok {
+			q.Set("email", v)
+		}
+		if v, ok := filter["includeDeleted"].(bool); ok {
+			q.Set("include_deleted", strconv.FormatBool(v))
+		}
+	}
+
+	params, err := parseListParams(q)
+	if err != nil {
+		return nil, &graphQLError{code: "BAD_USER_INPUT", message: err.Error()}
+	}
+
+	users, total, err := tenantFrom(p.Context).users.List(p.Context, params)
+	if err != nil {
+		return nil, graphQLUserError(err)
+	}
+
+	conn := &userConnection{Edges: []userEdge{}, TotalCount: total}
+	if len(users) > params.limit {
+		users = users[:params.limit]
+		conn.PageInfo.HasNextPage = true
+	}
+	for _, u := range users {
+		conn.Edges = append(conn.Edges, userEdge{Cursor: params.cursorAfter(u), Node: u})
+	}
+	if n := len(conn.Edges); n > 0 {
+		conn.PageInfo.EndCursor = &conn.Edges[n-1].Cursor
+	}
+	return conn, nil
+}
+
+func resolveCreateUser(p graphql.ResolveParams) (any, error) {
+	input, _ := p.Args["input"].(map[string]any)
+	u := user{}
+	u.Name, _ = input["name"].(string)
+	u.Email, _ = input["email"].(string)
+
+	u.normalize()
+	if errs := u.validate(); len(errs) > 0 {
+		return nil, graphQLUserError(&validationError{errs: errs})
+	}
+
+	created, err := tenantFrom(p.Context).users.Create(p.Context, u)
+	if err != nil {
+		return nil, graphQLUserError(err)
+	}
+	return created, nil
+}
+
+func resolveUpdateUser(p graphql.ResolveParams) (any, error) {
+	id, err := graphQLUserID(p)
+	if err != nil {
+		return nil, err
+	}
+
+	input, _ := p.Args["input"].(map[string]any)
+	updated, err := tenantFrom(p.Context).users.Update(p.Context, id, graphQLIfMatch(p), func(stored *user) error {
+		u := *stored
+		if v, ok := input["name"].(string); ok {
+			u.Name = v
+		}
+		if v, ok := input["email"].(string); ok {
+			u.Email = v
+		}
+
+		u.normalize()
+		if errs := u.validate(); len(errs) > 0 {
+			return &validationError{errs: errs}
+		}
+
+		stored.Name, stored.Email = u.Name, u.Email
+		return nil
+	})
+	if err != nil {
+		return nil, graphQLUserError(err)
+	}
+	return updated, nil
+}
+
+func resolveDeleteUser(p graphql.ResolveParams) (any, error) {
+	id, err := graphQLUserID(p)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tenantFrom(p.Context).users.Delete(p.Context, id, graphQLIfMatch(p)); err != nil {
+		return nil, graphQLUserError(err)
+	}
+	return true, nil
+}
+
+// graphqlHandler runs a GraphQL query or mutation against the tenant of the
+// request. As the GraphQL over HTTP convention has it, a document that was
+// read successfully is answered with 200 even when it fails, the failure
+// being reported in the errors of the result.
+func (s *server) graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	var req graphQLRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Query == "" {
+		writeProblem(w, r, http.StatusBadRequest, "query is required")
+		return
+	}
+
+	if doc, err := parser.Parse(parser.ParseParams{Source: req.Query}); err == nil {
+		if err := checkGraphQLLimits(doc, req.Variables); err != nil {
+			writeJSON(w, http.StatusOK, &graphql.Result{Errors: []gqlerrors.FormattedError{
+				{Message: err.Error(), Extensions: map[string]any{"code": "QUERY_TOO_COMPLEX"}},
+			}})
+			return
+		}
+	}
+	// A document that does not parse is left to graphql.Do, which reports
+	// the syntax error in the usual format.
+
+	result := graphql.Do(graphql.Params{
+		Schema:         s.graphql,
+		RequestString:  req.Query,
+		VariableValues: req.Variables,
+		OperationName:  req.OperationName,
+		Context:        r.Context(),
+	})
+	writeJSON(w, http.StatusOK, result)
+}
+
+// checkGraphQLLimits rejects documents with an operation nested deeper than
+// graphQLMaxDepth or costing more than graphQLMaxComplexity.
+func checkGraphQLLimits(doc *ast.Document, variables map[string]any) error {
+	fragments := map[string]*ast.FragmentDefinition{}
+	for _, def := range doc.Definitions {
+		if f, ok := def.(*ast.FragmentDefinition); ok && f.Name != nil {
+			fragments[f.Name.Value] = f
+		}
+	}
+
+	for _, def := range doc.Definitions {
+		op, ok := def.(*ast.OperationDefinition)
+		if !ok {
+			continue
+		}
+		c := &graphQLCost{fragments: fragments, variables: variables, defaults: map[string]ast.Value{}}
+		for _, v := range op.VariableDefinitions {
+			if v.Variable != nil && v.Variable.Name != nil && v.DefaultValue != nil {
+				c.defaults[v.Variable.Name.Value] = v.DefaultValue
+			}
+		}
+
+		depth, cost := c.selectionSet(op.SelectionSet, 1, map[string]bool{})
+		if depth > graphQLMaxDepth {
+			return fmt.Errorf("query is nested %d levels deep, the limit is %d", depth, graphQLMaxDepth)
+		}
+		if cost > graphQLMaxComplexity {
+			return fmt.Errorf("query has a complexity of %d, the limit is %d", cost, graphQLMaxComplexity)
+		}
+	}
+	return nil
+}
+
+type graphQLCost struct {
+	fragments map[string]*ast.FragmentDefinition
+	variables map[string]any
+	defaults  map[string]ast.Value
+}
+
+// selectionSet returns the depth and cost of the fields selected in set,
+// which sits at level depth. Fragments are expanded in place; visiting
+// tracks the ones on the current path so a cyclic document, which
+// validation rejects later anyway, cannot recurse forever.
+func (c *graphQLCost) selectionSet(set *ast.SelectionSet, depth int, visiting map[string]bool) (int, int) {
+	if set == nil {
+		return depth - 1, 0
+	}
+
+	maxDepth, cost := depth, 0
+	for _, sel := range set.Selections {
+		var d, n int
+		switch sel := sel.(type) {
+		case *ast.Field:
+			d, n = c.selectionSet(sel.SelectionSet, depth+1, visiting)
+			if sel.Name != nil && sel.Name.Value == "users" {
+				n *= c.first(sel)
+			}
+			n++
+		case *ast.InlineFragment:
+			d, n = c.selectionSet(sel.SelectionSet, depth, visiting)
+		case *ast.FragmentSpread:
+			if sel.Name == nil || visiting[sel.Name.Value] {
+				continue
+			}
+			f, ok := c.fragments[sel.Name.Value]
+			if !ok {
+				continue
+			}
+			visiting[sel.Name.Value] = true
+			d, n = c.selectionSet(f.SelectionSet, depth, visiting)
+			delete(visiting, sel.Name.Value)
+		}
+		maxDepth = max(maxDepth, d)
+		cost += n
+	}
+	return maxDepth, cost
+}
+
+// first returns how many users a users field asks for, counting the
+// largest page when the argument is missing or not a usable number.
+func (c *graphQLCost) first(field *ast.Field) int {
+	for _, arg := range field.Arguments {
+		if arg.Name == nil || arg.Name.Value != "first" {
+			continue
+		}
+		value := arg.Value
+		if v, ok := value.(*ast.Variable); ok && v.Name != nil {
+			if n, ok := c.variables[v.Name.Value].(float64); ok {
+				return clampPageSize(int(n))
+			}
+			value = c.defaults[v.Name.Value]
+		}
+		if v, ok := value.(*ast.IntValue); ok {
+			if n, err := strconv.Atoi(v.Value); err == nil {
+				return clampPageSize(n)
+			}
+		}
+		return maxPageSize
+	}
+	return defaultPageSize
+}
+
+func clampPageSize(n int) int {
+	return min(max(n, 1), maxPageSize)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/graphql-go/graphql/language/parser"
+)
+
+// nestedGraphQLQuery returns a query whose fields are nested depth levels
+// deep.
+func nestedGraphQLQuery(depth int) string {
+	return strings.Repeat("{ f ", depth) + strings.Repeat("}", depth)
+}
+
+func TestCheckGraphQLLimits(t *testing.T) {
+	// A full page of users with three fields each costs 1001, so one fits
+	// under the limit and two do not.
+	page := "users(first: 200) { edges { node { id name email } } }"
+
+	tests := []struct {
+		name      string
+		query     string
+		variables map[string]any
+		ok        bool
+	}{
+		{"at the depth limit", nestedGraphQLQuery(graphQLMaxDepth), nil, true},
+		{"past the depth limit", nestedGraphQLQuery(graphQLMaxDepth + 1), nil, false},
+		{"past the depth limit in a fragment", "query { ...F } fragment F on Query " + nestedGraphQLQuery(graphQLMaxDepth+1), nil, false},
+		{"past the depth limit in an inline fragment", "query { ... on Query " + nestedGraphQLQuery(graphQLMaxDepth+1) + " }", nil, false},
+		{"cyclic fragments", "query { ...A } fragment A on Query { ...B } fragment B on Query { ...A }", nil, true},
+
+		{"one full page", "{ " + page + " }", nil, true},
+		{"two full pages", "{ a: " + page + " b: " + page + " }", nil, false},
+		{"two full pages in a fragment", "{ a: users(first: 200) { ...E } b: users(first: 200) { ...E } } fragment E on UserConnection { edges { node { id name email } } }", nil, false},
+		{"small pages from a variable", "query($n: Int) { a: users(first: $n) { edges { node { id name email } } } b: users(first: $n) { edges { node { id name email } } } }", map[string]any{"n": float64(10)}, true},
+		{"full pages from a variable", "query($n: Int) { a: users(first: $n) { edges { node { id name email } } } b: users(first: $n) { edges { node { id name email } } } }", map[string]any{"n": float64(200)}, false},
+		{"full pages from a default", "query($n: Int = 200) { a: users(first: $n) { edges { node { id name email } } } b: users(first: $n) { edges { node { id name email } } } }", nil, false},
+		{"pages past the maximum count as the maximum", "{ a: users(first: 100000) { edges { node { id } } } }", nil, true},
+		{"unusable first counts as the maximum", `{ a: users(first: "x") { edges { node { id name email } } } b: users(first: "x") { edges { node { id name email } } } }`, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			doc, err := parser.Parse(parser.ParseParams{Source: tt.query})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := checkGraphQLLimits(doc, tt.variables); (err == nil) != tt.ok {
+				t.Errorf("checkGraphQLLimits: %v, want ok = %t", err, tt.ok)
+			}
+		})
+	}
+}
+
+// graphQLResponse is the part of a GraphQL result the tests look at.
+type graphQLResponse struct {
+	Data   map[string]any `json:"data"`
+	Errors []struct {
+		Message    string         `json:"message"`
+		Extensions map[string]any `json:"extensions"`
+	} `json:"errors"`
+}
+
+// serveGraphQL posts query to the /graphql route, gated like the server
+// gates it, with the given API key.
+func serveGraphQL(t *testing.T, s *server, ten *tenant, key, query string) graphQLResponse {
+	t.Helper()
+
+	body, err := json.Marshal(graphQLRequest{Query: query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/graphql", strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-API-Key", key)
+	rec := httptest.NewRecorder()
+	s.requireScope(scopeUsersRead, s.quiesce(s.graphqlHandler))(rec, req.WithContext(withTenant(req.Context(), ten)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp graphQLResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestGraphQLTooComplex(t *testing.T) {
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{graphql: schema}
+	ten := newTenant("", newTestDB(t), t.TempDir())
+	key, err := createAPIKey(ten.db, "reader", []string{scopeUsersRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := serveGraphQL(t, s, ten, key.Key, nestedGraphQLQuery(graphQLMaxDepth+1))
+	if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "QUERY_TOO_COMPLEX" {
+		t.Errorf("errors %+v, want QUERY_TOO_COMPLEX", resp.Errors)
+	}
+}
+
+// The /graphql route only requires users:read, so every mutation must
+// check for users:write itself.
+func TestGraphQLMutationScope(t *testing.T) {
+	schema, err := newGraphQLSchema()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &server{graphql: schema}
+	ten := newTenant("", newTestDB(t), t.TempDir())
+	reader, err := createAPIKey(ten.db, "reader", []string{scopeUsersRead})
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer, err := createAPIKey(ten.db, "writer", []string{scopeUsersRead, scopeUsersWrite})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	alice := mustCreate(t, ctx, ten.users, "Alice", "alice@example.com")
+
+	mutations := map[string]string{
+		"createUser": `mutation { createUser(input: {name: "Bob", email: "bob@example.com"}) { id } }`,
+		"updateUser": `mutation { updateUser(id: "` + strconv.FormatInt(alice.ID, 10) + `", input: {name: "Mallory"}) { id } }`,
+		"deleteUser": `mutation { deleteUser(id: "` + strconv.FormatInt(alice.ID, 10) + `") }`,
+	}
+	for name, query := range mutations {
+		t.Run(name, func(t *testing.T) {
+			resp := serveGraphQL(t, s, ten, reader.Key, query)
+			if len(resp.Errors) != 1 || resp.Errors[0].Extensions["code"] != "FORBIDDEN" {
+				t.Errorf("errors %+v, want FORBIDDEN", resp.Errors)
+			}
+		})
+	}
+
+	got, err := ten.users.Get(ctx, alice.ID, false)
+	if err != nil {
+		t.Fatalf("Alice after the forbidden mutations: %v", err)
+	}
+	if got.Name != "Alice" || got.Version != alice.Version {
+		t.Errorf("Alice changed: %+v", got)
+	}
+	if _, err := ten.users.GetByEmail(ctx, "bob@example.com"); err == nil {
+		t.Error("Bob was created")
+	}
+
+	resp := serveGraphQL(t, s, ten, writer.Key, mutations["createUser"])
+	if len(resp.Errors) != 0 || resp.Data["createUser"] == nil {
+		t.Errorf("createUser with users:write: %+v", resp)
+	}
+}
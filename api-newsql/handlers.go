@@ -0,0 +1,241 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+func pathID(r *http.Request) (int64, error) {
+	return strconv.ParseInt(r.PathValue("id"), 10, 64)
+}
+
+func (s *server) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	params, err := parseListParams(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	users, total, err := usersFor(r).List(r.Context(), params)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	page := userPage{Data: users, Total: total}
+	if len(users) > params.limit {
+		page.Data = users[:params.limit]
+		next := params.cursorAfter(page.Data[params.limit-1])
+		page.NextCursor = &next
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (s *server) createUserHandler(w http.ResponseWriter, r *http.Request) {
+	var u user
+	if err := decodeJSON(w, r, &u); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u.normalize()
+	if errs := u.validate(); len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	created, err := usersFor(r).Create(r.Context(), u)
+	if err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/users/%d", created.ID))
+	w.Header().Set("ETag", userETag(created.Version))
+	writeJSON(w, http.StatusCreated, created)
+}
+
+func (s *server) getUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	includeDeleted, _ := strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+	u, err := usersFor(r).Get(r.Context(), id, includeDeleted)
+	if err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	etag := userETag(u.Version)
+	w.Header().Set("ETag", etag)
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag, true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, u)
+}
+
+func (s *server) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	var u user
+	if err := decodeJSON(w, r, &u); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	u.normalize()
+	if errs := u.validate(); len(errs) > 0 {
+		writeValidationProblem(w, r, errs)
+		return
+	}
+
+	updated, err := usersFor(r).Update(r.Context(), id, r.Header.Get("If-Match"), func(stored *user) error {
+		stored.Name, stored.Email = u.Name, u.Email
+		return nil
+	})
+	if err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(updated.Version))
+	writeJSON(w, http.StatusOK, updated)
+}
+
+// patchUserHandler applies a JSON Merge Patch (RFC 7396) or a JSON Patch
+// (RFC 6902) to the user. Plain application/json is treated as a merge
+// patch. The patch is applied to the stored user as part of the update, so it
+// either fully applies or leaves the user untouched.
+func (s *server) patchUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "could not read request body")
+		return
+	}
+
+	var apply func(doc any) (any, error)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeMergePatch, "application/json":
+		var patch map[string]any
+		if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+			writeProblem(w, r, http.StatusBadRequest, "a merge patch must be a JSON object")
+			return
+		}
+		apply = func(doc any) (any, error) { return mergePatch(doc, patch), nil }
+	case contentTypeJSONPatch:
+		ops, err := parseJSONPatch(body)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		apply = ops.apply
+	default:
+		w.Header().Set("Accept-Patch", contentTypeMergePatch+", "+contentTypeJSONPatch)
+		writeProblem(w, r, http.StatusUnsupportedMediaType, "Content-Type must be "+contentTypeMergePatch+" or "+contentTypeJSONPatch)
+		return
+	}
+
+	patched, err := usersFor(r).Update(r.Context(), id, r.Header.Get("If-Match"), func(stored *user) error {
+		doc, err := userDocument(stored)
+		if err != nil {
+			return err
+		}
+		if doc, err = apply(doc); err != nil {
+			return err
+		}
+		u, err := userFromDocument(doc, id)
+		if err != nil {
+			return err
+		}
+
+		u.normalize()
+		if errs := u.validate(); len(errs) > 0 {
+			return &validationError{errs: errs}
+		}
+
+		stored.Name, stored.Email = u.Name, u.Email
+		return nil
+	})
+	if err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(patched.Version))
+	writeJSON(w, http.StatusOK, patched)
+}
+
+func (s *server) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	if err := usersFor(r).Delete(r.Context(), id, r.Header.Get("If-Match")); err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) restoreUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := pathID(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+
+	restored, err := usersFor(r).Restore(r.Context(), id, r.Header.Get("If-Match"))
+	if err != nil {
+		writeUserError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", userETag(restored.Version))
+	writeJSON(w, http.StatusOK, restored)
+}
+
+func writeUserError(w http.ResponseWriter, r *http.Request, err error) {
+	var patchErr *patchError
+	var validationErr *validationError
+	switch {
+	case errors.As(err, &validationErr):
+		writeValidationProblem(w, r, validationErr.errs)
+	case errors.As(err, &patchErr):
+		writeProblem(w, r, patchErr.status, patchErr.detail)
+	case errors.Is(err, errUserNotFound):
+		writeProblem(w, r, http.StatusNotFound, "User not found")
+	case errors.Is(err, errUserNotDeleted):
+		writeProblem(w, r, http.StatusConflict, "User is not deleted.")
+	case errors.Is(err, errPreconditionFailed):
+		writeProblem(w, r, http.StatusPreconditionFailed, "The user was modified since it was last read.")
+	case errors.Is(err, errEmailTaken):
+		writeProblem(w, r, http.StatusConflict, "A user with this email already exists.")
+	default:
+		writeServerError(w, r, err)
+	}
+}
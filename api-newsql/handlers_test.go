@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// decodeProblem reads the problem+json body of rec.
+func decodeProblem(t *testing.T, rec *httptest.ResponseRecorder) problem {
+	t.Helper()
+
+	resp := rec.Result()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("Content-Type %q, want application/problem+json", ct)
+	}
+	var p problem
+	if err := json.NewDecoder(resp.Body).Decode(&p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestListUsersCursor(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryUserRepository(newEventBroker())
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		mustCreate(t, ctx, repo, name, name+"@example.com")
+	}
+
+	list := func(query string) (int, userPage) {
+		t.Helper()
+		rec := serveUsers(repo, (&server{}).listUsersHandler, http.MethodGet, "/users?"+query, "", nil)
+		var page userPage
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+				t.Fatal(err)
+			}
+		} else if p := decodeProblem(t, rec); p.Status != rec.Code {
+			t.Errorf("problem status %d, response status %d", p.Status, rec.Code)
+		}
+		return rec.Code, page
+	}
+
+	// Following next_cursor walks every user exactly once.
+	var names []string
+	query := url.Values{"sort": {"-name"}, "limit": {"2"}}
+	for {
+		status, page := list(query.Encode())
+		if status != http.StatusOK {
+			t.Fatalf("status %d", status)
+		}
+		for _, u := range page.Data {
+			names = append(names, u.Name)
+		}
+		if page.NextCursor == nil {
+			break
+		}
+		query.Set("cursor", *page.NextCursor)
+	}
+	if len(names) != 3 || names[0] != "Carol" || names[2] != "Alice" {
+		t.Fatalf("walked %v", names)
+	}
+
+	_, first := list("sort=name&limit=1")
+	if first.NextCursor == nil {
+		t.Fatal("no next_cursor on the first page")
+	}
+	forge := func(c string) string { return base64.RawURLEncoding.EncodeToString([]byte(c)) }
+
+	tests := []struct {
+		name  string
+		query string
+	}{
+		{"not base64", "cursor=%21%21%21"},
+		{"not JSON", "cursor=" + forge("not json")},
+		{"not an object", "cursor=" + forge(`[1, 2]`)},
+		{"other sort", "sort=email&cursor=" + *first.NextCursor},
+		{"reversed sort", "sort=-name&cursor=" + *first.NextCursor},
+		{"no ID", "cursor=" + forge(`{"s": "id"}`)},
+		{"negative ID", "cursor=" + forge(`{"s": "id", "id": -1}`)},
+		{"value on the id sort", "cursor=" + forge(`{"s": "id", "v": "x", "id": 1}`)},
+		{"no value on the name sort", "sort=name&cursor=" + forge(`{"s": "name", "id": 1}`)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status, _ := list(tt.query); status != http.StatusBadRequest {
+				t.Errorf("status %d, want 400", status)
+			}
+		})
+	}
+}
+
+// serveUser sends a request for the user with the given ID, as the mux
+// would route it, with optional headers.
+func serveUser(repo UserRepository, h http.HandlerFunc, method string, id int64, header http.Header, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, fmt.Sprintf("/users/%d", id), strings.NewReader(body))
+	req.SetPathValue("id", strconv.FormatInt(id, 10))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req = req.WithContext(withTenant(req.Context(), &tenant{users: repo}))
+
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+// Invalid fields get 422 with one error per field, while bodies that are
+// not a user object at all get 400.
+func TestUserValidationProblem(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryUserRepository(newEventBroker())
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	s := &server{}
+
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		errors []fieldError
+	}{
+		{"empty object", `{}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "name", Message: "is required"},
+			{Field: "email", Message: "is required"},
+		}},
+		{"blank name", `{"name": "   ", "email": "bob@example.com"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "name", Message: "is required"},
+		}},
+		{"long name", `{"name": "` + strings.Repeat("é", maxNameLength+1) + `", "email": "bob@example.com"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "name", Message: fmt.Sprintf("must be at most %d characters", maxNameLength)},
+		}},
+		{"long email", `{"name": "Bob", "email": "` + strings.Repeat("b", maxEmailLength) + `@example.com"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "email", Message: fmt.Sprintf("must be at most %d characters", maxEmailLength)},
+		}},
+		{"email without @", `{"name": "Bob", "email": "bob"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "email", Message: "must be a valid email address"},
+		}},
+		{"email without a dot in the domain", `{"name": "Bob", "email": "bob@localhost"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "email", Message: "must be a valid email address"},
+		}},
+		{"email with a display name", `{"name": "Bob", "email": "Bob <bob@example.com>"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "email", Message: "must be a valid email address"},
+		}},
+		{"both invalid", `{"name": "", "email": "bob"}`, http.StatusUnprocessableEntity, []fieldError{
+			{Field: "name", Message: "is required"},
+			{Field: "email", Message: "must be a valid email address"},
+		}},
+		{"malformed JSON", `{"name": "Bob",`, http.StatusBadRequest, nil},
+		{"unknown field", `{"name": "Bob", "email": "bob@example.com", "role": "admin"}`, http.StatusBadRequest, nil},
+		{"wrong type", `{"name": 1, "email": "bob@example.com"}`, http.StatusBadRequest, nil},
+		{"two objects", `{"name": "Bob", "email": "bob@example.com"} {}`, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for method, rec := range map[string]*httptest.ResponseRecorder{
+				"POST": serveUsers(repo, s.createUserHandler, http.MethodPost, "/users", "application/json", strings.NewReader(tt.body)),
+				"PUT":  serveUser(repo, s.updateUserHandler, http.MethodPut, alice.ID, nil, tt.body),
+			} {
+				if rec.Code != tt.status {
+					t.Fatalf("%s: status %d, want %d: %s", method, rec.Code, tt.status, rec.Body)
+				}
+				p := decodeProblem(t, rec)
+				if tt.status == http.StatusUnprocessableEntity && (p.Type != validationProblemType || p.Status != tt.status) {
+					t.Errorf("%s: problem %+v", method, p)
+				}
+				if !slices.Equal(p.Errors, tt.errors) {
+					t.Errorf("%s: errors %+v, want %+v", method, p.Errors, tt.errors)
+				}
+			}
+		})
+	}
+
+	got, err := repo.Get(ctx, alice.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != alice.Version {
+		t.Errorf("rejected updates changed Alice: %+v", got)
+	}
+	if _, total, err := repo.List(ctx, listParams{limit: maxPageSize, sort: "id", column: "id"}); err != nil || total != 1 {
+		t.Errorf("rejected creates left %d users: %v", total, err)
+	}
+}
+
+// If-None-Match uses the weak comparison, so W/ tags match, while If-Match
+// uses the strong one and a W/ tag never satisfies it. Both accept lists
+// and "*".
+func TestUserConditionalRequests(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryUserRepository(newEventBroker())
+	s := &server{}
+
+	t.Run("If-None-Match", func(t *testing.T) {
+		alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+		etag := userETag(alice.Version)
+		stale := userETag(alice.Version + 1)
+
+		tests := []struct {
+			header string
+			status int
+		}{
+			{"", http.StatusOK},
+			{etag, http.StatusNotModified},
+			{"W/" + etag, http.StatusNotModified},
+			{stale, http.StatusOK},
+			{"W/" + stale, http.StatusOK},
+			{stale + ", " + etag, http.StatusNotModified},
+			{stale + ",W/" + etag, http.StatusNotModified},
+			{"*", http.StatusNotModified},
+			{strings.Trim(etag, `"`), http.StatusOK},
+		}
+		for _, tt := range tests {
+			rec := serveUser(repo, s.getUserHandler, http.MethodGet, alice.ID, http.Header{"If-None-Match": {tt.header}}, "")
+			if rec.Code != tt.status {
+				t.Errorf("If-None-Match %s: status %d, want %d", tt.header, rec.Code, tt.status)
+			}
+			if rec.Header().Get("ETag") != etag {
+				t.Errorf("If-None-Match %s: ETag %q, want %q", tt.header, rec.Header().Get("ETag"), etag)
+			}
+			if rec.Code == http.StatusNotModified && rec.Body.Len() > 0 {
+				t.Errorf("If-None-Match %s: 304 with a body", tt.header)
+			}
+		}
+	})
+
+	writes := []struct {
+		name string
+		h    http.HandlerFunc
+		body string
+		ok   int
+	}{
+		{"PUT", s.updateUserHandler, `{"name": "Alicia", "email": "alice@example.com"}`, http.StatusOK},
+		{"PATCH", s.patchUserHandler, `{"name": "Alicia"}`, http.StatusOK},
+		{"DELETE", s.deleteUserHandler, "", http.StatusNoContent},
+	}
+	tests := []struct {
+		name   string
+		header func(etag, stale string) string
+		ok     bool
+	}{
+		{"none", func(etag, stale string) string { return "" }, true},
+		{"current", func(etag, stale string) string { return etag }, true},
+		{"stale", func(etag, stale string) string { return stale }, false},
+		{"weak current", func(etag, stale string) string { return "W/" + etag }, false},
+		{"list with current", func(etag, stale string) string { return stale + ", " + etag }, true},
+		{"list with weak current", func(etag, stale string) string { return stale + ", W/" + etag }, false},
+		{"star", func(etag, stale string) string { return "*" }, true},
+		{"unquoted", func(etag, stale string) string { return strings.Trim(etag, `"`) }, false},
+	}
+
+	for i, w := range writes {
+		for j, tt := range tests {
+			t.Run(w.name+" If-Match "+tt.name, func(t *testing.T) {
+				u := mustCreate(t, ctx, repo, "Alice", fmt.Sprintf("alice%d-%d@example.com", i, j))
+				body := strings.ReplaceAll(w.body, "alice@example.com", u.Email)
+				header := http.Header{"Content-Type": {contentTypeMergePatch}}
+				if h := tt.header(userETag(u.Version), userETag(u.Version+1)); h != "" {
+					header.Set("If-Match", h)
+				}
+
+				rec := serveUser(repo, w.h, w.name, u.ID, header, body)
+				want := w.ok
+				if !tt.ok {
+					want = http.StatusPreconditionFailed
+				}
+				if rec.Code != want {
+					t.Fatalf("status %d, want %d: %s", rec.Code, want, rec.Body)
+				}
+
+				got, err := repo.Get(ctx, u.ID, false)
+				if w.name == "DELETE" {
+					if deleted := errors.Is(err, errUserNotFound); deleted != tt.ok {
+						t.Errorf("deleted = %t, want %t", deleted, tt.ok)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if updated := got.Version != u.Version; updated != tt.ok {
+					t.Errorf("updated = %t, want %t", updated, tt.ok)
+				}
+				if tt.ok && rec.Header().Get("ETag") != userETag(got.Version) {
+					t.Errorf("ETag %q, want %q", rec.Header().Get("ETag"), userETag(got.Version))
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	idempotencyKeyTTL    = 24 * time.Hour
+	maxIdempotencyKeyLen = 255
+)
+
+// replayedHeaders are the response headers stored with an idempotent
+// response and sent again when it is replayed.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// responseRecorder passes the response through to the client while keeping
+// a copy of the status and body.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// idempotent makes a POST safe to retry when the client sends an
+// Idempotency-Key header. The first request with a key reserves it and its
+// response is stored for idempotencyKeyTTL; repeats with the same body get
+// that response replayed, repeats with another body get 422, and repeats
+// while the first one is still running get 409. Keys are scoped to the
+// authenticated caller and stored in the tenant's database, so requireScope
+// must run first.
+func (s *server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLen {
+			writeProblem(w, r, http.StatusBadRequest, "Idempotency-Key must be at most 255 characters")
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "could not read request body")
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		caller := ""
+		if p, ok := principalFrom(r.Context()); ok {
+			caller = p.Subject
+		}
+
+		sum := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		hash := hex.EncodeToString(sum[:])
+
+		db := tenantFrom(r.Context()).db
+		reserved, err := reserveIdempotencyKey(db, caller, key, hash)
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		if !reserved {
+			replayIdempotentResponse(w, r, db, caller, key, hash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		if rec.status >= 500 || rec.status == 0 {
+			// Let the client retry with the same key after a server error.
+			if _, err := db.Exec("DELETE FROM idempotency_keys WHERE principal = ? AND key = ?", caller, key); err != nil {
+				log.Printf("releasing idempotency key: %v", err)
+			}
+			return
+		}
+
+		headers := map[string]string{}
+		for _, h := range replayedHeaders {
+			if v := rec.Header().Get(h); v != "" {
+				headers[h] = v
+			}
+		}
+		headersJSON, _ := json.Marshal(headers)
+
+		_, err = db.Exec("UPDATE idempotency_keys SET status = ?, headers = ?, body = ? WHERE principal = ? AND key = ?",
+			rec.status, string(headersJSON), rec.body.Bytes(), caller, key)
+		if err != nil {
+			log.Printf("storing idempotent response: %v", err)
+		}
+	}
+}
+
+// reserveIdempotencyKey claims key for a new request. It reports false when
+// an unexpired request with the same key already exists.
+func reserveIdempotencyKey(db *sql.DB, caller, key, hash string) (bool, error) {
+	now := time.Now().UTC()
+
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE expires_at < ?", now); err != nil {
+		return false, err
+	}
+
+	_, err := db.Exec("INSERT INTO idempotency_keys (principal, key, request_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		caller, key, hash, now, now.Add(idempotencyKeyTTL))
+	if isUniqueViolation(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, db *sql.DB, caller, key, hash string) {
+	var storedHash string
+	var status sql.NullInt64
+	var headersJSON sql.NullString
+	var body []byte
+	err := db.QueryRow("SELECT request_hash, status, headers, body FROM idempotency_keys WHERE principal = ? AND key = ?", caller, key).
+		Scan(&storedHash, &status, &headersJSON, &body)
+	if err == sql.ErrNoRows {
+		// The first request failed and released the key in the meantime.
+		writeProblem(w, r, http.StatusConflict, "A request with this Idempotency-Key was just released, retry it.")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	if storedHash != hash {
+		writeProblem(w, r, http.StatusUnprocessableEntity, "This Idempotency-Key was already used with a different request.")
+		return
+	}
+	if !status.Valid {
+		writeProblem(w, r, http.StatusConflict, "A request with this Idempotency-Key is still being processed.")
+		return
+	}
+
+	var headers map[string]string
+	json.Unmarshal([]byte(headersJSON.String), &headers)
+	for h, v := range headers {
+		w.Header().Set(h, v)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(int(status.Int64))
+	w.Write(body)
+}
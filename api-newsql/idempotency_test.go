@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// serveIdempotent sends a POST with the given Idempotency-Key and body to h
+// as subject, on tenant t.
+func serveIdempotent(h http.HandlerFunc, t *tenant, subject, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	ctx := withTenant(req.Context(), t)
+	ctx = withPrincipal(ctx, &principal{Subject: subject, Scopes: []string{scopeUsersWrite}})
+
+	rec := httptest.NewRecorder()
+	h(rec, req.WithContext(ctx))
+	return rec
+}
+
+func TestIdempotent(t *testing.T) {
+	ten := newTenant("", newTestDB(t), t.TempDir())
+
+	var calls atomic.Int64
+	status := http.StatusCreated
+	h := (&server{}).idempotent(func(w http.ResponseWriter, r *http.Request) {
+		n := calls.Add(1)
+		w.Header().Set("Location", fmt.Sprintf("/users/%d", n))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		fmt.Fprintf(w, `{"call": %d}`, n)
+	})
+
+	first := serveIdempotent(h, ten, "apikey:alice", "k1", `{"name": "Alice"}`)
+	if first.Code != http.StatusCreated || calls.Load() != 1 {
+		t.Fatalf("first request: status %d after %d calls", first.Code, calls.Load())
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		rec := serveIdempotent(h, ten, "apikey:alice", "k1", `{"name": "Alice"}`)
+		if calls.Load() != 1 {
+			t.Fatalf("the handler ran again, %d calls", calls.Load())
+		}
+		if rec.Code != first.Code || rec.Body.String() != first.Body.String() {
+			t.Errorf("replay: %d %s, want %d %s", rec.Code, rec.Body, first.Code, first.Body)
+		}
+		for _, h := range []string{"Location", "Content-Type"} {
+			if got, want := rec.Header().Get(h), first.Header().Get(h); got != want {
+				t.Errorf("replayed %s %q, want %q", h, got, want)
+			}
+		}
+		if rec.Header().Get("Idempotent-Replayed") != "true" {
+			t.Error("replay without Idempotent-Replayed")
+		}
+	})
+
+	t.Run("different body", func(t *testing.T) {
+		rec := serveIdempotent(h, ten, "apikey:alice", "k1", `{"name": "Bob"}`)
+		if rec.Code != http.StatusUnprocessableEntity || calls.Load() != 1 {
+			t.Errorf("status %d after %d calls, want 422 after 1", rec.Code, calls.Load())
+		}
+	})
+
+	t.Run("another caller", func(t *testing.T) {
+		before := calls.Load()
+		rec := serveIdempotent(h, ten, "apikey:bob", "k1", `{"name": "Alice"}`)
+		if rec.Code != http.StatusCreated || calls.Load() != before+1 {
+			t.Fatalf("status %d after %d calls, want 201 after %d", rec.Code, calls.Load(), before+1)
+		}
+		if rec.Header().Get("Idempotent-Replayed") != "" || rec.Body.String() == first.Body.String() {
+			t.Errorf("got the response of another caller: %s", rec.Body)
+		}
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		before := calls.Load()
+		serveIdempotent(h, ten, "apikey:alice", "", `{"name": "Alice"}`)
+		serveIdempotent(h, ten, "apikey:alice", "", `{"name": "Alice"}`)
+		if calls.Load() != before+2 {
+			t.Errorf("%d calls, want 2", calls.Load()-before)
+		}
+	})
+
+	t.Run("server error", func(t *testing.T) {
+		status = http.StatusInternalServerError
+		serveIdempotent(h, ten, "apikey:alice", "k2", `{"name": "Carol"}`)
+		status = http.StatusCreated
+
+		// The failed request released the key, so the retry runs.
+		before := calls.Load()
+		rec := serveIdempotent(h, ten, "apikey:alice", "k2", `{"name": "Carol"}`)
+		if rec.Code != http.StatusCreated || calls.Load() != before+1 {
+			t.Errorf("retry: status %d after %d calls", rec.Code, calls.Load()-before)
+		}
+	})
+}
+
+// A repeat that arrives while the first request with its key is still
+// running gets 409 instead of running the handler a second time.
+func TestIdempotentInFlight(t *testing.T) {
+	ten := newTenant("", newTestDB(t), t.TempDir())
+
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	var calls atomic.Int64
+	h := (&server{}).idempotent(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			close(started)
+			<-finish
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- serveIdempotent(h, ten, "apikey:alice", "k1", `{}`) }()
+	<-started
+
+	rec := serveIdempotent(h, ten, "apikey:alice", "k1", `{}`)
+	close(finish)
+	if rec.Code != http.StatusConflict {
+		t.Errorf("concurrent request: status %d, want 409", rec.Code)
+	}
+	if first := <-done; first.Code != http.StatusCreated {
+		t.Errorf("first request: status %d, want 201", first.Code)
+	}
+	if calls.Load() != 1 {
+		t.Errorf("%d calls, want 1", calls.Load())
+	}
+
+	// Once the first request is done, the repeat is a replay.
+	if rec := serveIdempotent(h, ten, "apikey:alice", "k1", `{}`); rec.Code != http.StatusCreated || rec.Header().Get("Idempotent-Replayed") != "true" {
+		t.Errorf("after the first request: status %d, replayed %q", rec.Code, rec.Header().Get("Idempotent-Replayed"))
+	}
+}
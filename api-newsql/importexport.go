@@ -0,0 +1,497 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	maxImportBytes   = 64 << 20
+	maxImportErrors  = 1000
+	importChunkRows  = 500
+	exportFlushEvery = 100
+
+	importReadTimeout = 30 * time.Second
+
+	importModeTx  = "transaction"
+	importModeRow = "row"
+
+	contentTypeCSV    = "text/csv"
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+// importRecord is one parsed row of an import. err is set when the row
+// itself is malformed; the import carries on with the next one.
+type importRecord struct {
+	line int
+	user user
+	err  error
+}
+
+// importReader returns the next record, or io.EOF once the body is
+// exhausted. Any other error aborts the whole import.
+type importReader func() (importRecord, error)
+
+type importRowError struct {
+	Line   int          `json:"line"`
+	Detail string       `json:"detail,omitempty"`
+	Errors []fieldError `json:"errors,omitempty"`
+}
+
+type importReport struct {
+	Mode      string           `json:"mode"`
+	Processed int              `json:"processed"`
+	Created   int              `json:"created"`
+	Failed    int              `json:"failed"`
+	Skipped   int              `json:"skipped"`
+	Errors    []importRowError `json:"errors"`
+	Truncated bool             `json:"errors_truncated,omitempty"`
+}
+
+func (rep *importReport) fail(e importRowError) {
+	rep.Failed++
+	if len(rep.Errors) < maxImportErrors {
+		rep.Errors = append(rep.Errors, e)
+	} else {
+		rep.Truncated = true
+	}
+}
+
+// deadlineReader moves the connection's read deadline forward before every
+// read, so a large body can take as long as it keeps arriving while a client
+// that stops sending still times out.
+type deadlineReader struct {
+	r       io.Reader
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d deadlineReader) Read(p []byte) (int, error) {
+	d.rc.SetReadDeadline(time.Now().Add(d.timeout))
+	return d.r.Read(p)
+}
+
+func newCSVImportReader(body io.Reader) (importReader, error) {
+	cr := csv.NewReader(body)
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("CSV body must start with a header row")
+	} else if err != nil {
+		return nil, fmt.Errorf("malformed CSV header: %w", err)
+	}
+
+	// The columns of an export are accepted so that its file can be imported
+	// again. The id is ignored, as every imported user gets a new one.
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "id", "name", "email", "deleted_at":
+		default:
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("duplicate CSV column %q", name)
+		}
+		columns[name] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, errors.New(`CSV header must contain a "name" column`)
+	}
+	if _, ok := columns["email"]; !ok {
+		return nil, errors.New(`CSV header must contain an "email" column`)
+	}
+	deletedAtColumn, hasDeletedAt := columns["deleted_at"]
+
+	return func() (importRecord, error) {
+		fields, err := cr.Read()
+		if err == io.EOF {
+			return importRecord{}, io.EOF
+		}
+
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) && errors.Is(parseErr.Err, csv.ErrFieldCount) {
+			return importRecord{line: parseErr.Line, err: errors.New("wrong number of fields")}, nil
+		} else if err != nil {
+			return importRecord{}, fmt.Errorf("malformed CSV: %w", err)
+		}
+
+		line, _ := cr.FieldPos(0)
+		rec := importRecord{
+			line: line,
+			user: user{Name: fields[columns["name"]], Email: fields[columns["email"]]},
+		}
+		if hasDeletedAt && fields[deletedAtColumn] != "" {
+			deletedAt, err := time.Parse(time.RFC3339Nano, fields[deletedAtColumn])
+			if err != nil {
+				rec.err = errors.New("deleted_at must be an RFC 3339 timestamp")
+			}
+			rec.user.DeletedAt = &deletedAt
+		}
+		return rec, nil
+	}, nil
+}
+
+func newNDJSONImportReader(body io.Reader) importReader {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxBodyBytes)
+	line := 0
+
+	return func() (importRecord, error) {
+		for scanner.Scan() {
+			line++
+			raw := bytes.TrimSpace(scanner.Bytes())
+			if len(raw) == 0 {
+				continue
+			}
+
+			var u user
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&u); err != nil {
+				return importRecord{line: line, err: errors.New("invalid JSON object")}, nil
+			}
+			return importRecord{line: line, user: u}, nil
+		}
+
+		if err := scanner.Err(); err != nil {
+			return importRecord{}, fmt.Errorf("reading NDJSON: %w", err)
+		}
+		return importRecord{}, io.EOF
+	}
+}
+
+// nextImportRow returns the next row to insert. Malformed and invalid rows
+// go to the report, and rows of users exported as deleted are skipped:
+// importing them would bring the users back.
+func nextImportRow(next importReader, report *importReport) (importRecord, error) {
+	for {
+		rec, err := next()
+		if err != nil {
+			return importRecord{}, err
+		}
+
+		report.Processed++
+		if rec.err != nil {
+			report.fail(importRowError{Line: rec.line, Detail: rec.err.Error()})
+			continue
+		}
+		if rec.user.DeletedAt != nil {
+			report.Skipped++
+			continue
+		}
+
+		rec.user.normalize()
+		if errs := rec.user.validate(); len(errs) > 0 {
+			report.fail(importRowError{Line: rec.line, Errors: errs})
+			continue
+		}
+		return rec, nil
+	}
+}
+
+// insertRows inserts a chunk of rows, reporting those whose email is taken.
+func (rep *importReport) insertRows(insert func(u user) error, rows []importRecord) error {
+	for _, rec := range rows {
+		if err := insert(rec.user); errors.Is(err, errEmailTaken) {
+			rep.fail(importRowError{Line: rec.line, Errors: []fieldError{{Field: "email", Message: "is already taken"}}})
+			continue
+		} else if err != nil {
+			return err
+		}
+		rep.Created++
+	}
+	return nil
+}
+
+// spooledRow is a validated row of a transaction import, kept in the spool
+// file until the transaction reads it back.
+type spooledRow struct {
+	Line  int    `json:"line"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+// spoolImport reads and validates the whole body into a temporary file. The
+// caller closes and removes the file. Failures of the file itself are
+// *fs.PathError, anything else comes from the body.
+func spoolImport(next importReader, report *importReport) (*os.File, error) {
+	f, err := os.CreateTemp("", "users-import-*.ndjson")
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(f)
+	enc := json.NewEncoder(bw)
+	for {
+		rec, err := nextImportRow(next, report)
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			err = enc.Encode(spooledRow{Line: rec.line, Name: rec.user.Name, Email: rec.user.Email})
+		}
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			return nil, err
+		}
+	}
+
+	if err := bw.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// importUsersHandler reads a CSV or NDJSON body into the users table
+// importChunkRows rows at a time, so memory stays bounded whatever the size
+// of the body.
+//
+// In "row" mode failed rows are skipped, and every chunk is read from the
+// body before it is inserted with its own repository import, so the write
+// lock is only held while inserting. In "transaction" mode any failed row
+// rolls the whole import back, so the rows must go through one repository
+// import: the body is validated into a temporary file first, and the import
+// reads the chunks back from it, never waiting on a slow client.
+func (s *server) importUsersHandler(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = importModeTx
+	}
+	if mode != importModeTx && mode != importModeRow {
+		writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("mode must be %q or %q", importModeTx, importModeRow))
+		return
+	}
+
+	// Large imports take longer than the server's read and write timeouts
+	// allow. maxImportBytes bounds the body and importReadTimeout how long
+	// the client may stall between reads.
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	body := deadlineReader{r: http.MaxBytesReader(w, r.Body, maxImportBytes), rc: rc, timeout: importReadTimeout}
+
+	var next importReader
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mediaType {
+	case contentTypeCSV:
+		var err error
+		if next, err = newCSVImportReader(body); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+	case contentTypeNDJSON, "application/ndjson":
+		next = newNDJSONImportReader(body)
+	default:
+		writeProblem(w, r, http.StatusUnsupportedMediaType, fmt.Sprintf("Content-Type must be %s or %s", contentTypeCSV, contentTypeNDJSON))
+		return
+	}
+
+	report := importReport{Mode: mode, Errors: []importRowError{}}
+	users := usersFor(r)
+
+	if mode == importModeRow {
+		chunk := make([]importRecord, 0, importChunkRows)
+		for done := false; !done; {
+			rec, err := nextImportRow(next, &report)
+			switch {
+			case err == io.EOF:
+				done = true
+			case err != nil:
+				detail := err.Error()
+				if report.Created > 0 {
+					detail = fmt.Sprintf("%s; the %d users imported before it were kept", detail, report.Created)
+				}
+				writeProblem(w, r, http.StatusBadRequest, detail)
+				return
+			default:
+				chunk = append(chunk, rec)
+			}
+			if len(chunk) == 0 || (!done && len(chunk) < importChunkRows) {
+				continue
+			}
+
+			err = users.Import(r.Context(), func(insert func(u user) error) (bool, error) {
+				return true, report.insertRows(insert, chunk)
+			})
+			if err != nil {
+				writeServerError(w, r, err)
+				return
+			}
+			chunk = chunk[:0]
+		}
+	} else {
+		spool, err := spoolImport(next, &report)
+		var pathErr *fs.PathError
+		if errors.As(err, &pathErr) {
+			writeServerError(w, r, err)
+			return
+		} else if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		if report.Failed > 0 {
+			writeJSON(w, http.StatusUnprocessableEntity, report)
+			return
+		}
+
+		err = users.Import(r.Context(), func(insert func(u user) error) (bool, error) {
+			dec := json.NewDecoder(bufio.NewReader(spool))
+			chunk := make([]importRecord, 0, importChunkRows)
+			for {
+				chunk = chunk[:0]
+				for len(chunk) < importChunkRows {
+					var row spooledRow
+					if err := dec.Decode(&row); err == io.EOF {
+						break
+					} else if err != nil {
+						return false, err
+					}
+					chunk = append(chunk, importRecord{line: row.Line, user: user{Name: row.Name, Email: row.Email}})
+				}
+				if len(chunk) == 0 {
+					return report.Failed == 0, nil
+				}
+				if err := report.insertRows(insert, chunk); err != nil {
+					return false, err
+				}
+			}
+		})
+		if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+	}
+
+	// Rows taken by another user fail after the malformed ones were
+	// reported; keep the report in body order.
+	slices.SortStableFunc(report.Errors, func(a, b importRowError) int { return cmp.Compare(a.Line, b.Line) })
+
+	if mode == importModeTx && report.Failed > 0 {
+		report.Created = 0
+		writeJSON(w, http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+// exportUsersHandler streams every user as CSV or NDJSON straight from the
+// repository, flushing as it goes instead of buffering the table.
+func (s *server) exportUsersHandler(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+	}
+	if format != "csv" && format != "ndjson" {
+		writeProblem(w, r, http.StatusBadRequest, `format must be "csv" or "ndjson"`)
+		return
+	}
+
+	includeDeleted, _ := strconv.ParseBool(r.URL.Query().Get("include_deleted"))
+
+	// The export streams for as long as the table takes to read, so the
+	// server's write timeout does not apply.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	flusher, _ := w.(http.Flusher)
+	var writeRow func(u *user) error
+	var flush func() error
+
+	// start sets up the response on the first row, so that an export that
+	// fails before producing anything can still answer with a problem.
+	start := func() error {
+		if format == "csv" {
+			w.Header().Set("Content-Type", contentTypeCSV)
+			w.Header().Set("Content-Disposition", `attachment; filename="users.csv"`)
+			cw := csv.NewWriter(w)
+			writeRow = func(u *user) error {
+				deletedAt := ""
+				if u.DeletedAt != nil {
+					deletedAt = u.DeletedAt.Format(time.RFC3339Nano)
+				}
+				return cw.Write([]string{strconv.FormatInt(u.ID, 10), u.Name, u.Email, deletedAt})
+			}
+			flush = func() error {
+				cw.Flush()
+				return cw.Error()
+			}
+			return cw.Write([]string{"id", "name", "email", "deleted_at"})
+		}
+
+		w.Header().Set("Content-Type", contentTypeNDJSON)
+		w.Header().Set("Content-Disposition", `attachment; filename="users.ndjson"`)
+		enc := json.NewEncoder(w)
+		writeRow = func(u *user) error { return enc.Encode(u) }
+		flush = func() error { return nil }
+		return nil
+	}
+
+	n := 0
+	err := usersFor(r).Export(r.Context(), includeDeleted, func(u *user) error {
+		if writeRow == nil {
+			if err := start(); err != nil {
+				return err
+			}
+		}
+		if err := writeRow(u); err != nil {
+			return err
+		}
+
+		n++
+		if n%exportFlushEvery == 0 {
+			if err := flush(); err != nil {
+				return err
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		return nil
+	})
+	if err != nil && writeRow == nil {
+		writeServerError(w, r, err)
+		return
+	}
+	if err != nil {
+		// Rows are already on the wire; all that is left is to log.
+		log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+		return
+	}
+
+	if writeRow == nil {
+		if err := start(); err != nil {
+			return
+		}
+	}
+	flush()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveUsers runs h for a request to the tenant whose users are in repo.
+func serveUsers(repo UserRepository, h http.HandlerFunc, method, target, contentType string, body io.Reader) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	req = req.WithContext(withTenant(req.Context(), &tenant{users: repo}))
+
+	rec := httptest.NewRecorder()
+	h(rec, req)
+	return rec
+}
+
+func importUsers(t *testing.T, repo UserRepository, mode, contentType, body string) importReport {
+	t.Helper()
+
+	rec := serveUsers(repo, (&server{}).importUsersHandler, http.MethodPost, "/users:import?mode="+mode, contentType, strings.NewReader(body))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("import: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var report importReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	return report
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, tc := range []struct {
+		format      string
+		contentType string
+	}{
+		{"csv", contentTypeCSV},
+		{"ndjson", contentTypeNDJSON},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			ctx := context.Background()
+			src := newMemoryUserRepository(newEventBroker())
+			mustCreate(t, ctx, src, "Alice", "alice@example.com")
+			bob := mustCreate(t, ctx, src, "Bob", "bob@example.com")
+			mustCreate(t, ctx, src, "Carol", "carol@example.com")
+			if err := src.Delete(ctx, bob.ID, ""); err != nil {
+				t.Fatal(err)
+			}
+
+			rec := serveUsers(src, (&server{}).exportUsersHandler, http.MethodGet, "/users:export?include_deleted=true&format="+tc.format, "", nil)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("export: status %d: %s", rec.Code, rec.Body)
+			}
+
+			// The deleted user is exported but not brought back.
+			dst := newMemoryUserRepository(newEventBroker())
+			report := importUsers(t, dst, importModeTx, tc.contentType, rec.Body.String())
+			if report.Processed != 3 || report.Created != 2 || report.Skipped != 1 || report.Failed != 0 {
+				t.Fatalf("report = %+v, want 3 processed, 2 created and 1 skipped", report)
+			}
+
+			for _, email := range []string{"alice@example.com", "carol@example.com"} {
+				if _, err := dst.GetByEmail(ctx, email); err != nil {
+					t.Errorf("%s was not imported: %v", email, err)
+				}
+			}
+			if _, err := dst.GetByEmail(ctx, "bob@example.com"); err == nil {
+				t.Error("deleted user bob@example.com was imported")
+			}
+		})
+	}
+}
+
+// An import larger than a chunk stores every row, in both modes, and
+// reports failures by their line in the body.
+func TestImportAcrossChunks(t *testing.T) {
+	const rows = 2*importChunkRows + 1
+
+	var body strings.Builder
+	body.WriteString("name,email\n")
+	for i := range rows {
+		fmt.Fprintf(&body, "User %d,user%d@example.com\n", i, i)
+	}
+
+	for _, mode := range []string{importModeTx, importModeRow} {
+		t.Run(mode, func(t *testing.T) {
+			repo := newMemoryUserRepository(newEventBroker())
+			report := importUsers(t, repo, mode, contentTypeCSV, body.String())
+			if report.Created != rows || report.Failed != 0 {
+				t.Fatalf("report = %+v, want %d created", report, rows)
+			}
+
+			_, total, err := repo.List(context.Background(), listParams{limit: 1, sort: "id", column: "id"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != rows {
+				t.Fatalf("stored %d users, want %d", total, rows)
+			}
+		})
+	}
+
+	// The last row duplicates the first, which sits in another chunk.
+	dup := body.String() + "Again,USER0@example.com\n"
+
+	repo := newMemoryUserRepository(newEventBroker())
+	report := importUsers(t, repo, importModeRow, contentTypeCSV, dup)
+	if report.Created != rows || report.Failed != 1 || report.Errors[0].Line != rows+2 {
+		t.Fatalf("report = %+v, want %d created and line %d failed", report, rows, rows+2)
+	}
+
+	repo = newMemoryUserRepository(newEventBroker())
+	rec := serveUsers(repo, (&server{}).importUsersHandler, http.MethodPost, "/users:import", contentTypeCSV, strings.NewReader(dup))
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("transaction import with a duplicate: status %d, want 422", rec.Code)
+	}
+	if _, total, _ := repo.List(context.Background(), listParams{limit: 1, sort: "id", column: "id"}); total != 0 {
+		t.Fatalf("failed transaction import left %d users", total)
+	}
+}
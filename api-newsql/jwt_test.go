@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT returns a token with the given header algorithm, signed with key:
+// a []byte secret for HS256, an *rsa.PrivateKey for RS256 and nothing at
+// all for any other algorithm.
+func signJWT(t *testing.T, alg string, key any, claims map[string]any) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestJWTVerify(t *testing.T) {
+	now := time.Now()
+	secret := []byte("shared secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The bytes an attacker would use as an HMAC secret to forge an RS256
+	// verifier into accepting HS256.
+	publicDER, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacOnly := &jwtVerifier{hmacSecret: secret, issuer: "https://issuer.example", audience: "api-newsql"}
+	rsaOnly := &jwtVerifier{rsaKey: &rsaKey.PublicKey, issuer: "https://issuer.example", audience: "api-newsql"}
+
+	claims := func(changes map[string]any) map[string]any {
+		c := map[string]any{
+			"sub":   "alice",
+			"iss":   "https://issuer.example",
+			"aud":   "api-newsql",
+			"exp":   now.Add(time.Hour).Unix(),
+			"scope": "users:read",
+		}
+		for k, v := range changes {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name     string
+		verifier *jwtVerifier
+		token    string
+		ok       bool
+	}{
+		{"HS256", hmacOnly, signJWT(t, "HS256", secret, claims(nil)), true},
+		{"RS256", rsaOnly, signJWT(t, "RS256", rsaKey, claims(nil)), true},
+		{"audience list", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"aud": []string{"other", "api-newsql"}})), true},
+
+		{"alg none", hmacOnly, signJWT(t, "none", nil, claims(nil)), false},
+		{"alg none without secret", rsaOnly, signJWT(t, "none", nil, claims(nil)), false},
+		{"HS256 signed with the RSA public key", rsaOnly, signJWT(t, "HS256", publicDER, claims(nil)), false},
+		{"RS256 to an HS256 verifier", hmacOnly, signJWT(t, "RS256", rsaKey, claims(nil)), false},
+		{"wrong secret", hmacOnly, signJWT(t, "HS256", []byte("other secret"), claims(nil)), false},
+		{"tampered claims", hmacOnly, tamperJWT(t, signJWT(t, "HS256", secret, claims(nil)), claims(map[string]any{"scope": "admin"})), false},
+		{"malformed", hmacOnly, "not.a-token", false},
+
+		{"no expiry", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"exp": nil})), false},
+		{"expired within the leeway", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"exp": now.Add(-jwtLeeway / 2).Unix()})), true},
+		{"expired beyond the leeway", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"exp": now.Add(-2 * jwtLeeway).Unix()})), false},
+		{"not before within the leeway", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"nbf": now.Add(jwtLeeway / 2).Unix()})), true},
+		{"not before beyond the leeway", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"nbf": now.Add(2 * jwtLeeway).Unix()})), false},
+
+		{"wrong issuer", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"iss": "https://evil.example"})), false},
+		{"no issuer", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"iss": nil})), false},
+		{"wrong audience", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"aud": "other"})), false},
+		{"audience list without ours", hmacOnly, signJWT(t, "HS256", secret, claims(map[string]any{"aud": []string{"other"}})), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.verifier.verify(tt.token, now)
+			if (err == nil) != tt.ok {
+				t.Fatalf("verify: %v, want ok = %t", err, tt.ok)
+			}
+			if err == nil && got.Subject != "alice" {
+				t.Errorf("subject %q, want alice", got.Subject)
+			}
+		})
+	}
+}
+
+// tamperJWT replaces the claims of token, keeping its header and signature.
+func tamperJWT(t *testing.T, token string, claims map[string]any) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(token, ".")
+	return parts[0] + "." + base64.RawURLEncoding.EncodeToString(payload) + "." + parts[2]
+}
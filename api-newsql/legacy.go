@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// deprecated marks responses from the pre-REST routes so clients can find
+// the route that replaces them.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		next(w, r)
+	}
+}
+
+// legacyBodyID reads the user ID the old routes expect in the JSON body and
+// restores the body so the handler it delegates to can decode it again.
+func legacyBodyID(w http.ResponseWriter, r *http.Request) (int64, error) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBodyBytes))
+	if err != nil {
+		return 0, errors.New("could not read request body")
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	var payload struct {
+		ID int64 `json:"id"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return 0, errors.New("request body must be a JSON object with an \"id\" field")
+	}
+
+	return payload.ID, nil
+}
+
+func (s *server) legacyGetUserHandler(w http.ResponseWriter, r *http.Request) {
+	r.SetPathValue("id", r.URL.Query().Get("id"))
+	s.getUserHandler(w, r)
+}
+
+func (s *server) legacyUpdateUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := legacyBodyID(w, r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.SetPathValue("id", strconv.FormatInt(id, 10))
+	s.updateUserHandler(w, r)
+}
+
+func (s *server) legacyDeleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := legacyBodyID(w, r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	r.SetPathValue("id", strconv.FormatInt(id, 10))
+	s.deleteUserHandler(w, r)
+}
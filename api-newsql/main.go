@@ -1,191 +1,230 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"flag"
+	"log"
 	"net/http"
-	"strconv"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/graphql-go/graphql"
 )
 
 type user struct {
 	ID    int64  `json:"id"`
 	Name  string `json:"name"`
 	Email string `json:"email"`
+
+	// Version is bumped on every write and exposed only through the ETag
+	// header.
+	Version int64 `json:"-"`
+
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
 }
 
-func main() {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/users", listUsersHandler)
-	mux.HandleFunc("/users/create", createUserHandler)
-	mux.HandleFunc("/users/update", updateUserHandler)
-	mux.HandleFunc("/users/delete", deleteUserHandler)
-	mux.HandleFunc("/users/get", getUserHandler)
-
-	fmt.Println("Server running on http://localhost:8082")
-	err := http.ListenAndServe(":8082", mux)
-	if err != nil {
-		fmt.Println("Error starting server:", err)
-	}
+type server struct {
+	// db is the database of the default tenant, which also keeps the
+	// operator keys that manage the tenants. Handlers otherwise reach the
+	// data through the tenant of the request.
+	db      *sql.DB
+	jwt     *jwtVerifier
+	graphql graphql.Schema
+	resets  passwordResetSender
+
+	tenants      *tenantPool
+	tenantDomain string
 }
 
-func listUsersHandler(w http.ResponseWriter, r *http.Request) {
-	db, err := sql.Open("sqlite3", "users.db")
+func main() {
+	dbPath := flag.String("db", "users.db", "path to the SQLite database file")
+	jwtPublicKey := flag.String("jwt-public-key", "", "PEM file with the RSA public key used to verify RS256 tokens")
+	jwtIssuer := flag.String("jwt-issuer", "", "required iss claim of bearer tokens")
+	jwtAudience := flag.String("jwt-audience", "", "required aud claim of bearer tokens")
+	addr := flag.String("addr", envString("ADDR", defaultAddr), "address to listen on")
+	readHeaderTimeout := flag.Duration("read-header-timeout", envDuration("READ_HEADER_TIMEOUT", defaultReadHeaderTimeout), "time allowed to read request headers")
+	readTimeout := flag.Duration("read-timeout", envDuration("READ_TIMEOUT", defaultReadTimeout), "time allowed to read a whole request")
+	writeTimeout := flag.Duration("write-timeout", envDuration("WRITE_TIMEOUT", defaultWriteTimeout), "time allowed to write a response")
+	idleTimeout := flag.Duration("idle-timeout", envDuration("IDLE_TIMEOUT", defaultIdleTimeout), "how long idle keep-alive connections stay open")
+	backupDir := flag.String("backup-dir", envString("BACKUP_DIR", defaultBackupDir), "directory where database backups are stored")
+	shutdownTimeout := flag.Duration("shutdown-timeout", envDuration("SHUTDOWN_TIMEOUT", defaultShutdownTimeout), "how long to wait for in-flight requests on shutdown")
+	tenantsDir := flag.String("tenants-dir", envString("TENANTS_DIR", ""), "directory holding one database per tenant; empty disables multi-tenancy")
+	tenantDomain := flag.String("tenant-domain", envString("TENANT_DOMAIN", ""), "base domain whose subdomains name the tenant, e.g. users.example.com")
+	maxOpenTenants := flag.Int("max-open-tenants", envInt("MAX_OPEN_TENANTS", defaultMaxOpenTenants), "how many tenant databases are kept open at once")
+	devLogResetTokens := flag.Bool("dev-log-reset-tokens", envBool("DEV_LOG_RESET_TOKENS", false), "write password reset tokens to the log; for local development only")
+	flag.Parse()
+
+	db, err := openDB(*dbPath)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Fatal("Error opening database: ", err)
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT * FROM users")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if err := requireFTS5(db); err != nil {
+		log.Fatal("Error opening database: ", err)
 	}
-	defer rows.Close()
 
-	users := []*user{}
-	for rows.Next() {
-		var u user
-		if err := rows.Scan(&u.ID, &u.Name, &u.Email); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+	if flag.Arg(0) == "migrate" {
+		if err := runMigrateCommand(db, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Error running migrations: ", err)
 		}
-		users = append(users, &u)
-	}
-
-	if err := json.NewEncoder(w).Encode(users); err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-}
 
-func createUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	if err := migrateUp(db); err != nil {
+		log.Fatal("Error running migrations: ", err)
 	}
 
-	var u user
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	db, err := sql.Open("sqlite3", "users.db")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if flag.Arg(0) == "apikey" {
+		if err := runAPIKeyCommand(db, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Error managing API keys: ", err)
+		}
 		return
 	}
-	defer db.Close()
 
-	insertSQL := "INSERT INTO users (name, email) VALUES (?, ?)"
-	result, err := db.Exec(insertSQL, u.Name, u.Email)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if flag.Arg(0) == "backup" {
+		if err := runBackupCommand(db, *backupDir, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal("Error managing backups: ", err)
+		}
 		return
 	}
 
-	lastID, _ := result.LastInsertId()
-	u.ID = lastID
-
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(u)
-}
-
-func updateUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPut {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	verifier := &jwtVerifier{
+		hmacSecret: []byte(os.Getenv("JWT_HS256_SECRET")),
+		issuer:     *jwtIssuer,
+		audience:   *jwtAudience,
 	}
-
-	var u user
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	if *jwtPublicKey != "" {
+		if verifier.rsaKey, err = loadRSAPublicKey(*jwtPublicKey); err != nil {
+			log.Fatal("Error loading JWT public key: ", err)
+		}
 	}
 
-	db, err := sql.Open("sqlite3", "users.db")
+	schema, err := newGraphQLSchema()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Fatal("Error building GraphQL schema: ", err)
 	}
-	defer db.Close()
 
-	updateSQL := "UPDATE users SET name = ?, email = ? WHERE id = ?"
-	_, err = db.Exec(updateSQL, u.Name, u.Email, u.ID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	if *devLogResetTokens {
+		log.Print("Warning: password reset tokens are written to the log (-dev-log-reset-tokens)")
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(u)
-}
-
-func deleteUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
+	s := &server{
+		db:           db,
+		jwt:          verifier,
+		graphql:      schema,
+		resets:       logResetSender{logTokens: *devLogResetTokens},
+		tenants:      newTenantPool(newTenant("", db, *backupDir), *tenantsDir, *backupDir, *maxOpenTenants),
+		tenantDomain: *tenantDomain,
 	}
 
-	var u user
-	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
+	mux := s.routes()
+	if err := checkOpenAPI(mux.patterns); err != nil {
+		log.Fatal("Error checking OpenAPI document: ", err)
 	}
 
-	db, err := sql.Open("sqlite3", "users.db")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	srv := &http.Server{
+		Addr:              *addr,
+		Handler:           s.resolveTenant(mux),
+		ReadHeaderTimeout: *readHeaderTimeout,
+		ReadTimeout:       *readTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
 	}
-	defer db.Close()
+	srv.RegisterOnShutdown(s.tenants.closeStreams)
 
-	deleteSQL := "DELETE FROM users WHERE id = ?"
-	_, err = db.Exec(deleteSQL, u.ID)
+	err = serve(srv, *shutdownTimeout)
+	s.tenants.close()
+	if closeErr := db.Close(); closeErr != nil {
+		log.Print("Error closing database: ", closeErr)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		log.Fatal("Error running server: ", err)
 	}
-
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprintf(w, "User with ID %d has been deleted", u.ID)
+	log.Print("Server stopped")
 }
 
-func getUserHandler(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+// serve runs srv until SIGINT or SIGTERM, then stops accepting connections
+// and waits up to timeout for in-flight requests before returning.
+func serve(srv *http.Server, timeout time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	idStr := r.URL.Query().Get("id")
-	id, err := strconv.ParseInt(idStr, 10, 64)
-	if err != nil {
-		http.Error(w, "Invalid user ID", http.StatusBadRequest)
-		return
-	}
+	errc := make(chan error, 1)
+	go func() {
+		log.Printf("Server running on %s", srv.Addr)
+		errc <- srv.ListenAndServe()
+	}()
 
-	db, err := sql.Open("sqlite3", "users.db")
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
 	}
-	defer db.Close()
+	stop()
 
-	var u user
-	row := db.QueryRow("SELECT * FROM users WHERE id = ?", id)
-	err = row.Scan(&u.ID, &u.Name, &u.Email)
-	if err == sql.ErrNoRows {
-		http.Error(w, "User not found", http.StatusNotFound)
-		return
-	} else if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	log.Printf("Shutting down, waiting up to %s for in-flight requests", timeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := srv.Shutdown(shutdownCtx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// Requests still running past the deadline are cut off.
+		srv.Close()
 	}
+	return err
+}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(u)
+func (s *server) routes() *routeMux {
+	read := func(h http.HandlerFunc) http.HandlerFunc { return s.requireScope(scopeUsersRead, h) }
+	write := func(h http.HandlerFunc) http.HandlerFunc { return s.requireScope(scopeUsersWrite, s.quiesce(h)) }
+	admin := func(h http.HandlerFunc) http.HandlerFunc { return s.requireScope(scopeAdmin, h) }
+	operator := func(h http.HandlerFunc) http.HandlerFunc { return s.requireScope(scopeOperator, requireOperator(h)) }
+
+	mux := &routeMux{ServeMux: http.NewServeMux()}
+	mux.HandleFunc("GET /openapi.json", openAPIHandler)
+	mux.HandleFunc("GET /docs", docsHandler)
+
+	mux.HandleFunc("POST /auth/login", s.quiesce(s.loginHandler))
+	mux.HandleFunc("POST /auth/logout", s.requireSession(s.quiesce(s.logoutHandler)))
+	mux.HandleFunc("POST /auth/password", s.requireSession(s.quiesce(s.changePasswordHandler)))
+	mux.HandleFunc("POST /auth/password-reset", s.quiesce(s.requestPasswordResetHandler))
+	mux.HandleFunc("POST /auth/password-reset/confirm", s.quiesce(s.confirmPasswordResetHandler))
+
+	mux.HandleFunc("GET /users", read(s.listUsersHandler))
+	mux.HandleFunc("POST /users", write(s.idempotent(s.createUserHandler)))
+	mux.HandleFunc("POST /users:import", write(s.importUsersHandler))
+	mux.HandleFunc("GET /users:export", read(s.exportUsersHandler))
+	mux.HandleFunc("GET /users/search", read(s.searchUsersHandler))
+	mux.HandleFunc("GET /users/events", read(s.userEventsHandler))
+	mux.HandleFunc("GET /users/{id}", read(s.getUserHandler))
+	mux.HandleFunc("PUT /users/{id}", write(s.updateUserHandler))
+	mux.HandleFunc("PATCH /users/{id}", write(s.patchUserHandler))
+	mux.HandleFunc("DELETE /users/{id}", write(s.deleteUserHandler))
+	mux.HandleFunc("POST /users/{id}/restore", write(s.restoreUserHandler))
+	mux.HandleFunc("PUT /users/{id}/password", write(s.setPasswordHandler))
+	mux.HandleFunc("GET /users/{id}/history", read(s.userHistoryHandler))
+	mux.HandleFunc("POST /graphql", read(s.quiesce(s.graphqlHandler)))
+
+	mux.HandleFunc("GET /admin/api-keys", admin(s.listAPIKeysHandler))
+	mux.HandleFunc("POST /admin/api-keys", admin(s.quiesce(s.createAPIKeyHandler)))
+	mux.HandleFunc("DELETE /admin/api-keys/{id}", admin(s.quiesce(s.revokeAPIKeyHandler)))
+	mux.HandleFunc("GET /admin/backups", admin(s.listBackupsHandler))
+	mux.HandleFunc("POST /admin/backups", admin(s.createBackupHandler))
+	mux.HandleFunc("POST /admin/backups/{name}/restore", admin(s.restoreBackupHandler))
+	mux.HandleFunc("GET /admin/tenants", operator(s.listTenantsHandler))
+	mux.HandleFunc("POST /admin/tenants", operator(s.provisionTenantHandler))
+	mux.HandleFunc("DELETE /admin/tenants/{id}", operator(s.deprovisionTenantHandler))
+
+	// Deprecated aliases kept while clients move to the routes above.
+	mux.HandleFunc("POST /users/create", deprecated("/users", write(s.idempotent(s.createUserHandler))))
+	mux.HandleFunc("PUT /users/update", deprecated("/users/{id}", write(s.legacyUpdateUserHandler)))
+	mux.HandleFunc("DELETE /users/delete", deprecated("/users/{id}", write(s.legacyDeleteUserHandler)))
+	mux.HandleFunc("GET /users/get", deprecated("/users/{id}", read(s.legacyGetUserHandler)))
+
+	return mux
 }
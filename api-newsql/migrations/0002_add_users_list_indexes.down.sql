@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS idx_users_email_id;
+DROP INDEX IF EXISTS idx_users_name_id;
@@ -0,0 +1,2 @@
+CREATE INDEX IF NOT EXISTS idx_users_name_id ON users (name, id);
+CREATE INDEX IF NOT EXISTS idx_users_email_id ON users (email, id);
@@ -0,0 +1 @@
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_unique ON users (email COLLATE NOCASE);
@@ -0,0 +1,9 @@
+DROP INDEX IF EXISTS idx_user_audit_user_id;
+DROP TABLE IF EXISTS user_audit;
+
+-- Without deleted_at, soft-deleted users would come back as active ones.
+DELETE FROM users WHERE deleted_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_users_email_unique;
+CREATE UNIQUE INDEX idx_users_email_unique ON users (email COLLATE NOCASE);
+
+ALTER TABLE users DROP COLUMN deleted_at;
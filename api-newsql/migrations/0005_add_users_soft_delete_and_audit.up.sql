@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN deleted_at TIMESTAMP;
+
+DROP INDEX IF EXISTS idx_users_email_unique;
+CREATE UNIQUE INDEX idx_users_email_unique ON users (email COLLATE NOCASE) WHERE deleted_at IS NULL;
+
+CREATE TABLE user_audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	user_id INTEGER NOT NULL,
+	action TEXT NOT NULL,
+	before TEXT,
+	after TEXT,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX idx_user_audit_user_id ON user_audit (user_id, id);
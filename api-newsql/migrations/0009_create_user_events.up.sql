@@ -0,0 +1,7 @@
+CREATE TABLE user_events (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	type TEXT NOT NULL,
+	user_id INTEGER NOT NULL,
+	data TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS password_resets;
+DROP TABLE IF EXISTS sessions;
+
+ALTER TABLE users DROP COLUMN locked_until;
+ALTER TABLE users DROP COLUMN failed_logins;
+ALTER TABLE users DROP COLUMN password_hash;
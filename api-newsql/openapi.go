@@ -0,0 +1,68 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// openAPIDocument is maintained by hand next to the handlers. checkOpenAPI
+// runs at startup so that a route added without documenting it stops the
+// server instead of going unnoticed.
+//
+//go:embed openapi.json
+var openAPIDocument []byte
+
+//go:embed docs.html
+var docsPage []byte
+
+// routeMux records the patterns registered on it so they can be compared
+// with the OpenAPI document.
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func (m *routeMux) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	m.ServeMux.HandleFunc(pattern, handler)
+	m.patterns = append(m.patterns, pattern)
+}
+
+// checkOpenAPI reports every "METHOD /path" pattern that has no matching
+// operation in the OpenAPI document.
+func checkOpenAPI(patterns []string) error {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPIDocument, &doc); err != nil {
+		return fmt.Errorf("openapi.json: %w", err)
+	}
+
+	var missing []string
+	for _, pattern := range patterns {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			missing = append(missing, pattern+" (no method)")
+			continue
+		}
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			missing = append(missing, pattern)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("routes missing from openapi.json: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
+
+func docsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(docsPage)
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	mux := (&server{}).routes()
+
+	if err := checkOpenAPI(mux.patterns); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckOpenAPIReportsUndocumentedRoutes(t *testing.T) {
+	err := checkOpenAPI([]string{"GET /users", "GET /undocumented", "/no-method"})
+	if err == nil {
+		t.Fatal("checkOpenAPI accepted undocumented routes")
+	}
+
+	for _, want := range []string{"GET /undocumented", "/no-method"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "GET /users") {
+		t.Errorf("error %q reports the documented GET /users", err)
+	}
+}
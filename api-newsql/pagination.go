@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// sortColumns whitelists the fields accepted by ?sort=, mapped to the SQL
+// column they order by. A leading "-" in the parameter reverses the order.
+var sortColumns = map[string]string{
+	"id":    "id",
+	"name":  "name",
+	"email": "email",
+}
+
+type listParams struct {
+	limit          int
+	sort           string
+	column         string
+	desc           bool
+	namePrefix     string
+	emailPrefix    string
+	after          *pageCursor
+	includeDeleted bool
+}
+
+// pageCursor is the keyset position of the last row of a page. It is handed
+// to clients as an opaque base64 token and only accepted back with the same
+// sort it was issued for.
+type pageCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v,omitempty"`
+	ID    int64  `json:"id"`
+}
+
+type userPage struct {
+	Data       []*user `json:"data"`
+	NextCursor *string `json:"next_cursor"`
+	Total      int64   `json:"total"`
+}
+
+func encodeCursor(c pageCursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(token string) (*pageCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	var c pageCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID < 1 {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return &c, nil
+}
+
+func parseListParams(q url.Values) (listParams, error) {
+	p := listParams{limit: defaultPageSize, sort: "id", column: "id"}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return p, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+		p.limit = limit
+	}
+
+	if v := q.Get("sort"); v != "" {
+		column, ok := sortColumns[strings.TrimPrefix(v, "-")]
+		if !ok {
+			return p, fmt.Errorf("cannot sort by %q", v)
+		}
+		p.sort = v
+		p.column = column
+		p.desc = strings.HasPrefix(v, "-")
+	}
+
+	if v := q.Get("include_deleted"); v != "" {
+		includeDeleted, err := strconv.ParseBool(v)
+		if err != nil {
+			return p, errors.New("include_deleted must be true or false")
+		}
+		p.includeDeleted = includeDeleted
+	}
+
+	p.namePrefix = q.Get("name")
+	p.emailPrefix = q.Get("email")
+
+	if v := q.Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			return p, err
+		}
+		if c.Sort != p.sort {
+			return p, errors.New("cursor was issued for a different sort")
+		}
+		// Only the name and email sorts carry a value, and neither field
+		// can be empty, so any other combination was not issued by us.
+		if (p.column == "id") != (c.Value == "") {
+			return p, errors.New("invalid cursor")
+		}
+		p.after = c
+	}
+
+	return p, nil
+}
+
+// filterSQL returns the WHERE conditions shared by the page query and the
+// total count.
+func (p listParams) filterSQL() ([]string, []any) {
+	var conds []string
+	var args []any
+
+	if !p.includeDeleted {
+		conds = append(conds, "deleted_at IS NULL")
+	}
+
+	if p.namePrefix != "" {
+		conds = append(conds, `name LIKE ? ESCAPE '\'`)
+		args = append(args, likePrefix(p.namePrefix))
+	}
+	if p.emailPrefix != "" {
+		conds = append(conds, `email LIKE ? ESCAPE '\'`)
+		args = append(args, likePrefix(p.emailPrefix))
+	}
+
+	return conds, args
+}
+
+// pageSQL builds the keyset query for one page. It selects one row more
+// than the limit so the caller can tell whether another page follows.
+func (p listParams) pageSQL() (string, []any) {
+	conds, args := p.filterSQL()
+
+	op, dir := ">", "ASC"
+	if p.desc {
+		op, dir = "<", "DESC"
+	}
+
+	if p.after != nil {
+		if p.column == "id" {
+			conds = append(conds, "id "+op+" ?")
+			args = append(args, p.after.ID)
+		} else {
+			conds = append(conds, fmt.Sprintf("(%[1]s %[2]s ? OR (%[1]s = ? AND id %[2]s ?))", p.column, op))
+			args = append(args, p.after.Value, p.after.Value, p.after.ID)
+		}
+	}
+
+	query := "SELECT " + userColumns + " FROM users"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+	if p.column == "id" {
+		query += " ORDER BY id " + dir
+	} else {
+		query += fmt.Sprintf(" ORDER BY %s %s, id %s", p.column, dir, dir)
+	}
+	query += " LIMIT ?"
+	args = append(args, p.limit+1)
+
+	return query, args
+}
+
+func (p listParams) countSQL() (string, []any) {
+	conds, args := p.filterSQL()
+
+	query := "SELECT COUNT(*) FROM users"
+	if len(conds) > 0 {
+		query += " WHERE " + strings.Join(conds, " AND ")
+	}
+
+	return query, args
+}
+
+// cursorAfter returns the cursor pointing past u for the current sort.
+func (p listParams) cursorAfter(u *user) string {
+	c := pageCursor{Sort: p.sort, ID: u.ID}
+	switch p.column {
+	case "name":
+		c.Value = u.Name
+	case "email":
+		c.Value = u.Email
+	}
+	return encodeCursor(c)
+}
+
+func likePrefix(prefix string) string {
+	r := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return r.Replace(prefix) + "%"
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	minPasswordLength = 8
+	maxPasswordLength = 128
+
+	// Argon2id parameters, following the second recommended option of
+	// RFC 9106 scaled down to a memory cost that suits a small server.
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+
+	// maxConcurrentHashes bounds the live memory of Argon2id, which
+	// allocates argon2Memory KiB per hash, to 256 MiB however many logins
+	// arrive at once. Hashes beyond it wait for a slot.
+	maxConcurrentHashes = 4
+)
+
+var passwordHashSlots = make(chan struct{}, maxConcurrentHashes)
+
+var errMalformedPasswordHash = errors.New("malformed password hash")
+
+// dummyPasswordHash is verified against when a login names an unknown user,
+// so that the response takes as long as for a wrong password.
+var dummyPasswordHash = sync.OnceValue(func() string {
+	return mustHashPassword("not a real password")
+})
+
+func validatePassword(password string) string {
+	switch n := utf8.RuneCountInString(password); {
+	case password == "":
+		return "is required"
+	case n < minPasswordLength:
+		return fmt.Sprintf("must be at least %d characters", minPasswordLength)
+	case n > maxPasswordLength:
+		return fmt.Sprintf("must be at most %d characters", maxPasswordLength)
+	}
+	return ""
+}
+
+// hashPassword returns an Argon2id hash in the PHC string format, which
+// keeps the parameters next to the hash so they can be raised later without
+// invalidating stored passwords.
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	key := argon2Key([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func mustHashPassword(password string) string {
+	hash, err := hashPassword(password)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// verifyPassword reports whether password matches a hash made by
+// hashPassword, using the parameters stored in the hash.
+func verifyPassword(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return false, errMalformedPasswordHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false, errMalformedPasswordHash
+	}
+
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false, errMalformedPasswordHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, errMalformedPasswordHash
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, errMalformedPasswordHash
+	}
+
+	got := argon2Key([]byte(password), salt, time, memory, threads, uint32(len(want)))
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
+
+// argon2Key runs argon2.IDKey once a slot of passwordHashSlots is free.
+func argon2Key(password, salt []byte, time, memory uint32, threads uint8, keyLen uint32) []byte {
+	passwordHashSlots <- struct{}{}
+	defer func() { <-passwordHashSlots }()
+
+	return argon2.IDKey(password, salt, time, memory, threads, keyLen)
+}
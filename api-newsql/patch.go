@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeMergePatch = "application/merge-patch+json"
+	contentTypeJSONPatch  = "application/json-patch+json"
+)
+
+// patchError is a patch document that could not be applied. status is 409
+// for a failed "test" operation and 422 for a patch that does not fit the
+// document, such as a path that does not exist.
+type patchError struct {
+	status int
+	detail string
+}
+
+func (e *patchError) Error() string { return e.detail }
+
+// validationError carries field errors out of a write transaction.
+type validationError struct {
+	errs []fieldError
+}
+
+func (e *validationError) Error() string { return "validation failed" }
+
+// mergePatch applies an RFC 7396 JSON Merge Patch: objects are merged
+// recursively, null removes a member and any other value replaces it.
+func mergePatch(target, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = map[string]any{}
+	}
+
+	for k, v := range patchObj {
+		if v == nil {
+			delete(targetObj, k)
+		} else {
+			targetObj[k] = mergePatch(targetObj[k], v)
+		}
+	}
+	return targetObj
+}
+
+// jsonPatchOp is one operation of an RFC 6902 JSON Patch. Value is nil
+// when the member is missing and holds "null" for a null value.
+type jsonPatchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from"`
+	Value json.RawMessage `json:"value"`
+}
+
+type jsonPatch []jsonPatchOp
+
+func parseJSONPatch(body []byte) (jsonPatch, error) {
+	var ops jsonPatch
+	if err := json.Unmarshal(body, &ops); err != nil {
+		return nil, fmt.Errorf("a JSON Patch must be an array of operations")
+	}
+
+	for i, op := range ops {
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return nil, fmt.Errorf("operation %d (%s) requires a value", i, op.Op)
+			}
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return nil, fmt.Errorf("operation %d: from: %w", i, err)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("operation %d: unknown op %q", i, op.Op)
+		}
+		if _, err := parsePointer(op.Path); err != nil {
+			return nil, fmt.Errorf("operation %d: path: %w", i, err)
+		}
+	}
+
+	return ops, nil
+}
+
+// apply runs the operations in order against doc. Any failing operation
+// aborts the whole patch.
+func (p jsonPatch) apply(doc any) (any, error) {
+	for i, op := range p {
+		var err error
+		doc, err = op.apply(doc)
+		if err != nil {
+			if pe, ok := err.(*patchError); ok {
+				pe.detail = fmt.Sprintf("operation %d (%s %s): %s", i, op.Op, op.Path, pe.detail)
+				return nil, pe
+			}
+			return nil, err
+		}
+	}
+	return doc, nil
+}
+
+func (op jsonPatchOp) apply(doc any) (any, error) {
+	path, _ := parsePointer(op.Path)
+
+	var value any
+	if op.Value != nil {
+		if err := json.Unmarshal(op.Value, &value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch op.Op {
+	case "add":
+		return pointerAdd(doc, path, value)
+	case "remove":
+		doc, _, err := pointerRemove(doc, path)
+		return doc, err
+	case "replace":
+		doc, _, err := pointerRemove(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, value)
+	case "move":
+		from, _ := parsePointer(op.From)
+		doc, moved, err := pointerRemove(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, moved)
+	case "copy":
+		from, _ := parsePointer(op.From)
+		copied, err := pointerGet(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		return pointerAdd(doc, path, deepCopy(copied))
+	case "test":
+		current, err := pointerGet(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !reflect.DeepEqual(current, value) {
+			return nil, &patchError{status: http.StatusConflict, detail: "test failed"}
+		}
+		return doc, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// parsePointer splits an RFC 6901 JSON Pointer into unescaped tokens.
+func parsePointer(ptr string) ([]string, error) {
+	if ptr == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("JSON Pointer %q must start with /", ptr)
+	}
+
+	tokens := strings.Split(ptr[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func pointerGet(doc any, path []string) (any, error) {
+	for _, token := range path {
+		switch node := doc.(type) {
+		case map[string]any:
+			v, ok := node[token]
+			if !ok {
+				return nil, missingPath(token)
+			}
+			doc = v
+		case []any:
+			i, err := arrayIndex(token, len(node)-1)
+			if err != nil {
+				return nil, err
+			}
+			doc = node[i]
+		default:
+			return nil, missingPath(token)
+		}
+	}
+	return doc, nil
+}
+
+func pointerAdd(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]any:
+		node[last] = value
+		return doc, nil
+	case []any:
+		i := len(node)
+		if last != "-" {
+			if i, err = arrayIndex(last, len(node)); err != nil {
+				return nil, err
+			}
+		}
+		node = append(node[:i], append([]any{value}, node[i:]...)...)
+		return pointerSet(doc, path[:len(path)-1], node)
+	default:
+		return nil, missingPath(last)
+	}
+}
+
+func pointerRemove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, doc, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]any:
+		v, ok := node[last]
+		if !ok {
+			return nil, nil, missingPath(last)
+		}
+		delete(node, last)
+		return doc, v, nil
+	case []any:
+		i, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, nil, err
+		}
+		v := node[i]
+		node = append(node[:i:i], node[i+1:]...)
+		doc, err = pointerSet(doc, path[:len(path)-1], node)
+		return doc, v, err
+	default:
+		return nil, nil, missingPath(last)
+	}
+}
+
+// pointerSet replaces the value at path, which is needed when an array
+// changes length and its parent must point to the new slice.
+func pointerSet(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, err := pointerGet(doc, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	last := path[len(path)-1]
+
+	switch node := parent.(type) {
+	case map[string]any:
+		node[last] = value
+	case []any:
+		i, err := arrayIndex(last, len(node)-1)
+		if err != nil {
+			return nil, err
+		}
+		node[i] = value
+	}
+	return doc, nil
+}
+
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || i > max || (len(token) > 1 && token[0] == '0') {
+		return 0, &patchError{status: http.StatusUnprocessableEntity, detail: fmt.Sprintf("invalid array index %q", token)}
+	}
+	return i, nil
+}
+
+func missingPath(token string) error {
+	return &patchError{status: http.StatusUnprocessableEntity, detail: fmt.Sprintf("path member %q does not exist", token)}
+}
+
+func deepCopy(v any) any {
+	b, _ := json.Marshal(v)
+	var c any
+	json.Unmarshal(b, &c)
+	return c
+}
+
+// userDocument is the JSON form of u that patches are applied to.
+func userDocument(u *user) (any, error) {
+	b, err := json.Marshal(user{ID: u.ID, Name: u.Name, Email: u.Email})
+	if err != nil {
+		return nil, err
+	}
+
+	var doc any
+	err = json.Unmarshal(b, &doc)
+	return doc, err
+}
+
+// userFromDocument reads a patched document back into a user, rejecting
+// members that are not part of the user and changes to its ID.
+func userFromDocument(doc any, id int64) (*user, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var patched struct {
+		ID    int64  `json:"id"`
+		Name  string `json:"name"`
+		Email string `json:"email"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patched); err != nil {
+		return nil, &patchError{status: http.StatusUnprocessableEntity, detail: "patched user is invalid: " + err.Error()}
+	}
+	if patched.ID != id {
+		return nil, &validationError{errs: []fieldError{{Field: "id", Message: "cannot be changed"}}}
+	}
+
+	return &user{ID: id, Name: patched.Name, Email: patched.Email}, nil
+}
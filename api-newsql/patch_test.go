@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+func mustJSON(t *testing.T, s string) any {
+	t.Helper()
+
+	var v any
+	if err := json.Unmarshal([]byte(s), &v); err != nil {
+		t.Fatalf("invalid JSON %s: %v", s, err)
+	}
+	return v
+}
+
+// The examples of RFC 6902, appendix A, followed by edge cases of array
+// indexes and pointer escaping. status is the patchError status expected
+// when applying the patch fails, 0 when it succeeds.
+var jsonPatchTests = []struct {
+	name   string
+	doc    string
+	patch  string
+	want   string
+	status int
+}{
+	{"A.1 adding an object member",
+		`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux"}]`,
+		`{"baz": "qux", "foo": "bar"}`, 0},
+	{"A.2 adding an array element",
+		`{"foo": ["bar", "baz"]}`, `[{"op": "add", "path": "/foo/1", "value": "qux"}]`,
+		`{"foo": ["bar", "qux", "baz"]}`, 0},
+	{"A.3 removing an object member",
+		`{"baz": "qux", "foo": "bar"}`, `[{"op": "remove", "path": "/baz"}]`,
+		`{"foo": "bar"}`, 0},
+	{"A.4 removing an array element",
+		`{"foo": ["bar", "qux", "baz"]}`, `[{"op": "remove", "path": "/foo/1"}]`,
+		`{"foo": ["bar", "baz"]}`, 0},
+	{"A.5 replacing a value",
+		`{"baz": "qux", "foo": "bar"}`, `[{"op": "replace", "path": "/baz", "value": "boo"}]`,
+		`{"baz": "boo", "foo": "bar"}`, 0},
+	{"A.6 moving a value",
+		`{"foo": {"bar": "baz", "waldo": "fred"}, "qux": {"corge": "grault"}}`,
+		`[{"op": "move", "from": "/foo/waldo", "path": "/qux/thud"}]`,
+		`{"foo": {"bar": "baz"}, "qux": {"corge": "grault", "thud": "fred"}}`, 0},
+	{"A.7 moving an array element",
+		`{"foo": ["all", "grass", "cows", "eat"]}`, `[{"op": "move", "from": "/foo/1", "path": "/foo/3"}]`,
+		`{"foo": ["all", "cows", "eat", "grass"]}`, 0},
+	{"A.8 testing a value: success",
+		`{"baz": "qux", "foo": ["a", 2, "c"]}`,
+		`[{"op": "test", "path": "/baz", "value": "qux"}, {"op": "test", "path": "/foo/1", "value": 2}]`,
+		`{"baz": "qux", "foo": ["a", 2, "c"]}`, 0},
+	{"A.9 testing a value: error",
+		`{"baz": "qux"}`, `[{"op": "test", "path": "/baz", "value": "bar"}]`,
+		``, http.StatusConflict},
+	{"A.10 adding a nested member object",
+		`{"foo": "bar"}`, `[{"op": "add", "path": "/child", "value": {"grandchild": {}}}]`,
+		`{"foo": "bar", "child": {"grandchild": {}}}`, 0},
+	{"A.11 ignoring unrecognized elements",
+		`{"foo": "bar"}`, `[{"op": "add", "path": "/baz", "value": "qux", "xyz": 123}]`,
+		`{"foo": "bar", "baz": "qux"}`, 0},
+	{"A.12 adding to a nonexistent target",
+		`{"foo": "bar"}`, `[{"op": "add", "path": "/baz/bat", "value": "qux"}]`,
+		``, http.StatusUnprocessableEntity},
+	{"A.14 ~ escape ordering",
+		`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": 10}]`,
+		`{"/": 9, "~1": 10}`, 0},
+	{"A.15 comparing strings and numbers",
+		`{"/": 9, "~1": 10}`, `[{"op": "test", "path": "/~01", "value": "10"}]`,
+		``, http.StatusConflict},
+	{"A.16 adding an array value",
+		`{"foo": ["bar"]}`, `[{"op": "add", "path": "/foo/-", "value": ["abc", "def"]}]`,
+		`{"foo": ["bar", ["abc", "def"]]}`, 0},
+
+	{"~1 in a path",
+		`{"a/b": 1}`, `[{"op": "replace", "path": "/a~1b", "value": 2}]`,
+		`{"a/b": 2}`, 0},
+	{"~0 in a path",
+		`{"m~n": 1}`, `[{"op": "remove", "path": "/m~0n"}]`,
+		`{}`, 0},
+	{"add at the end of an array",
+		`{"a": [1, 2]}`, `[{"op": "add", "path": "/a/2", "value": 3}]`,
+		`{"a": [1, 2, 3]}`, 0},
+	{"add at the start of an array",
+		`{"a": [1, 2]}`, `[{"op": "add", "path": "/a/0", "value": 0}]`,
+		`{"a": [0, 1, 2]}`, 0},
+	{"add past the end of an array",
+		`{"a": [1, 2]}`, `[{"op": "add", "path": "/a/3", "value": 3}]`,
+		``, http.StatusUnprocessableEntity},
+	{"index with a leading zero",
+		`{"a": [1, 2]}`, `[{"op": "replace", "path": "/a/01", "value": 3}]`,
+		``, http.StatusUnprocessableEntity},
+	{"negative index",
+		`{"a": [1, 2]}`, `[{"op": "remove", "path": "/a/-1"}]`,
+		``, http.StatusUnprocessableEntity},
+	{"remove past the end of an array",
+		`{"a": [1, 2]}`, `[{"op": "remove", "path": "/a/2"}]`,
+		``, http.StatusUnprocessableEntity},
+	{"- only works for add",
+		`{"a": [1, 2]}`, `[{"op": "replace", "path": "/a/-", "value": 3}]`,
+		``, http.StatusUnprocessableEntity},
+	{"remove the last array element",
+		`{"a": [1]}`, `[{"op": "remove", "path": "/a/0"}]`,
+		`{"a": []}`, 0},
+	{"nested arrays",
+		`{"a": [[1, 2], [3]]}`, `[{"op": "add", "path": "/a/0/1", "value": 9}, {"op": "remove", "path": "/a/1/0"}]`,
+		`{"a": [[1, 9, 2], []]}`, 0},
+	{"replace a missing member",
+		`{"a": 1}`, `[{"op": "replace", "path": "/b", "value": 2}]`,
+		``, http.StatusUnprocessableEntity},
+	{"copy",
+		`{"a": {"b": [1]}}`, `[{"op": "copy", "from": "/a", "path": "/c"}, {"op": "add", "path": "/c/b/-", "value": 2}]`,
+		`{"a": {"b": [1]}, "c": {"b": [1, 2]}}`, 0},
+	{"copy into an array",
+		`{"a": [1, 2]}`, `[{"op": "copy", "from": "/a/1", "path": "/a/0"}]`,
+		`{"a": [2, 1, 2]}`, 0},
+	{"move a missing member",
+		`{"a": 1}`, `[{"op": "move", "from": "/b", "path": "/c"}]`,
+		``, http.StatusUnprocessableEntity},
+	{"move into an array",
+		`{"a": [1, 2], "b": 3}`, `[{"op": "move", "from": "/b", "path": "/a/-"}]`,
+		`{"a": [1, 2, 3]}`, 0},
+	{"null values",
+		`{"a": 1}`, `[{"op": "add", "path": "/b", "value": null}, {"op": "test", "path": "/b", "value": null}, {"op": "replace", "path": "/a", "value": null}]`,
+		`{"a": null, "b": null}`, 0},
+	{"test a missing member",
+		`{"a": 1}`, `[{"op": "test", "path": "/b", "value": 1}]`,
+		``, http.StatusUnprocessableEntity},
+	{"test on an object",
+		`{"a": {"x": [1, {"y": true}]}}`, `[{"op": "test", "path": "/a", "value": {"x": [1, {"y": true}]}}]`,
+		`{"a": {"x": [1, {"y": true}]}}`, 0},
+	{"failed test undoes nothing after it",
+		`{"a": 1}`, `[{"op": "replace", "path": "/a", "value": 2}, {"op": "test", "path": "/a", "value": 1}, {"op": "remove", "path": "/a"}]`,
+		``, http.StatusConflict},
+	{"replace the whole document",
+		`{"a": 1}`, `[{"op": "replace", "path": "", "value": {"b": 2}}]`,
+		`{"b": 2}`, 0},
+}
+
+func TestJSONPatch(t *testing.T) {
+	for _, tt := range jsonPatchTests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := parseJSONPatch([]byte(tt.patch))
+			if err != nil {
+				t.Fatalf("parseJSONPatch: %v", err)
+			}
+
+			got, err := patch.apply(mustJSON(t, tt.doc))
+			if tt.status != 0 {
+				var pe *patchError
+				if !errors.As(err, &pe) || pe.status != tt.status {
+					t.Fatalf("got %v, %v; want a patch error with status %d", got, err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := mustJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+				t.Errorf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseJSONPatchErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		patch string
+	}{
+		{"not an array", `{"op": "add", "path": "/a", "value": 1}`},
+		{"unknown op", `[{"op": "merge", "path": "/a"}]`},
+		{"add without a value", `[{"op": "add", "path": "/a"}]`},
+		{"test without a value", `[{"op": "test", "path": "/a"}]`},
+		{"path without a slash", `[{"op": "remove", "path": "a"}]`},
+		{"move without a valid from", `[{"op": "move", "from": "a", "path": "/b"}]`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseJSONPatch([]byte(tt.patch)); err == nil {
+				t.Errorf("parseJSONPatch(%s) succeeded", tt.patch)
+			}
+		})
+	}
+}
+
+// The examples of RFC 7396, appendix A.
+func TestMergePatch(t *testing.T) {
+	tests := []struct {
+		target, patch, want string
+	}{
+		{`{"a": "b"}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "b"}`, `{"b": "c"}`, `{"a": "b", "b": "c"}`},
+		{`{"a": "b"}`, `{"a": null}`, `{}`},
+		{`{"a": "b", "b": "c"}`, `{"a": null}`, `{"b": "c"}`},
+		{`{"a": ["b"]}`, `{"a": "c"}`, `{"a": "c"}`},
+		{`{"a": "c"}`, `{"a": ["b"]}`, `{"a": ["b"]}`},
+		{`{"a": {"b": "c"}}`, `{"a": {"b": "d", "c": null}}`, `{"a": {"b": "d"}}`},
+		{`{"a": [{"b": "c"}]}`, `{"a": [1]}`, `{"a": [1]}`},
+		{`["a", "b"]`, `["c", "d"]`, `["c", "d"]`},
+		{`{"a": "b"}`, `["c"]`, `["c"]`},
+		{`{"a": "foo"}`, `null`, `null`},
+		{`{"a": "foo"}`, `"bar"`, `"bar"`},
+		{`{"e": null}`, `{"a": 1}`, `{"e": null, "a": 1}`},
+		{`[1, 2]`, `{"a": "b", "c": null}`, `{"a": "b"}`},
+		{`{}`, `{"a": {"bb": {"ccc": null}}}`, `{"a": {"bb": {}}}`},
+	}
+
+	for _, tt := range tests {
+		got := mergePatch(mustJSON(t, tt.target), mustJSON(t, tt.patch))
+		if want := mustJSON(t, tt.want); !reflect.DeepEqual(got, want) {
+			t.Errorf("mergePatch(%s, %s) = %v, want %v", tt.target, tt.patch, got, want)
+		}
+	}
+}
+
+// A merge patch must be an object; null, arrays and scalars are rejected
+// before the user is read.
+func TestPatchUserNotAnObject(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryUserRepository(newEventBroker())
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+
+	for _, body := range []string{`null`, `[]`, `"Bob"`, `1`, `true`, ``} {
+		header := http.Header{"Content-Type": {contentTypeMergePatch}}
+		if rec := serveUser(repo, (&server{}).patchUserHandler, http.MethodPatch, alice.ID, header, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("PATCH %q: status %d, want 400: %s", body, rec.Code, rec.Body)
+		}
+	}
+
+	got, err := repo.Get(ctx, alice.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != alice.Version {
+		t.Errorf("rejected patches changed Alice: %+v", got)
+	}
+}
+
+// A patch that changes nothing answers with the user as it is, without
+// writing, so the ETag stays valid and the history gets no entry.
+func TestPatchUserNoop(t *testing.T) {
+	ctx := context.Background()
+	repo := newMemoryUserRepository(newEventBroker())
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	etag := userETag(alice.Version)
+
+	tests := []struct {
+		contentType string
+		body        string
+	}{
+		{contentTypeMergePatch, `{}`},
+		{"application/json", `{}`},
+		{contentTypeMergePatch, `{"name": "Alice"}`},
+		{contentTypeMergePatch, `{"name": "  Alice  ", "email": "alice@example.com"}`},
+		{contentTypeMergePatch, `{"id": ` + strconv.FormatInt(alice.ID, 10) + `}`},
+		{contentTypeJSONPatch, `[]`},
+		{contentTypeJSONPatch, `[{"op": "test", "path": "/name", "value": "Alice"}]`},
+		{contentTypeJSONPatch, `[{"op": "replace", "path": "/name", "value": "Alice"}]`},
+	}
+	for _, tt := range tests {
+		header := http.Header{"Content-Type": {tt.contentType}, "If-Match": {etag}}
+		rec := serveUser(repo, (&server{}).patchUserHandler, http.MethodPatch, alice.ID, header, tt.body)
+		if rec.Code != http.StatusOK || rec.Header().Get("ETag") != etag {
+			t.Errorf("PATCH %s %s: status %d, ETag %q, want 200 and %q: %s", tt.contentType, tt.body, rec.Code, rec.Header().Get("ETag"), etag, rec.Body)
+		}
+	}
+
+	history, err := repo.History(ctx, alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("%d history entries after no-op patches, want only the creation", len(history))
+	}
+}
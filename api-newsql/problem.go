@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+)
+
+const maxBodyBytes = 1 << 20
+
+// problem is an RFC 7807 error response. Every handler reports failures
+// through writeProblem so clients get the same shape for every error.
+type problem struct {
+	Type     string       `json:"type"`
+	Title    string       `json:"title"`
+	Status   int          `json:"status"`
+	Detail   string       `json:"detail,omitempty"`
+	Instance string       `json:"instance,omitempty"`
+	Errors   []fieldError `json:"errors,omitempty"`
+}
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+const validationProblemType = "/problems/validation-error"
+
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	writeProblemJSON(w, problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
+
+func writeValidationProblem(w http.ResponseWriter, r *http.Request, errs []fieldError) {
+	writeProblemJSON(w, problem{
+		Type:     validationProblemType,
+		Title:    "Validation failed",
+		Status:   http.StatusUnprocessableEntity,
+		Detail:   "One or more fields are invalid.",
+		Instance: r.URL.Path,
+		Errors:   errs,
+	})
+}
+
+// writeServerError logs err and answers with a generic 500, so database
+// internals never reach the client.
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	writeProblem(w, r, http.StatusInternalServerError, "An unexpected error occurred.")
+}
+
+func writeProblemJSON(w http.ResponseWriter, p problem) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(p.Status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("encoding response: %v", err)
+	}
+}
+
+// decodeJSON reads a single JSON object from the request body, rejecting
+// unknown fields and bodies larger than maxBodyBytes. The returned error is
+// safe to show to the client.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		var maxErr *http.MaxBytesError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return fmt.Errorf("malformed JSON at offset %d", syntaxErr.Offset)
+		case errors.As(err, &typeErr):
+			return fmt.Errorf("field %q must be a %s", typeErr.Field, typeErr.Type)
+		case errors.As(err, &maxErr):
+			return fmt.Errorf("request body must not exceed %d bytes", maxBodyBytes)
+		case errors.Is(err, io.EOF):
+			return errors.New("request body must not be empty")
+		default:
+			return errors.New("invalid JSON body: " + err.Error())
+		}
+	}
+
+	if dec.More() {
+		return errors.New("request body must contain a single JSON object")
+	}
+
+	return nil
+}
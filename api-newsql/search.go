@@ -0,0 +1,150 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+const maxSearchTerms = 10
+
+// errFTS5Missing is returned when the SQLite driver was built without the
+// sqlite_fts5 tag, which the users_fts migration needs.
+var errFTS5Missing = errors.New("SQLite was built without FTS5; build with -tags sqlite_fts5")
+
+func requireFTS5(db *sql.DB) error {
+	var enabled bool
+	if err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&enabled); err != nil {
+		return err
+	}
+	if !enabled {
+		return errFTS5Missing
+	}
+	return nil
+}
+
+type searchHit struct {
+	user
+	Rank      float64         `json:"rank"`
+	Highlight searchHighlight `json:"highlight"`
+}
+
+type searchHighlight struct {
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type searchPage struct {
+	Data       []*searchHit `json:"data"`
+	NextCursor *string      `json:"next_cursor"`
+	Total      int64        `json:"total"`
+}
+
+// searchCursor is the position of the next page of a search. Results are
+// ordered by rank rather than by a unique column, so the cursor carries an
+// offset and is bound to the query it was issued for.
+type searchCursor struct {
+	Query  string `json:"q"`
+	Offset int    `json:"o"`
+}
+
+// searchTerms splits free text into the words a search matches on.
+// Punctuation only separates words, so "example.com" finds addresses at that
+// domain.
+func searchTerms(q string) []string {
+	words := strings.FieldsFunc(q, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	if len(words) > maxSearchTerms {
+		words = words[:maxSearchTerms]
+	}
+	return words
+}
+
+// Matches are marked with these control characters and only turned into
+// <mark> tags by escapeHighlight, after the rest of the text is escaped.
+const (
+	highlightOpen  = "\x02"
+	highlightClose = "\x03"
+)
+
+var markReplacer = strings.NewReplacer(highlightOpen, "<mark>", highlightClose, "</mark>")
+
+// escapeHighlight HTML-escapes a field marked with highlightOpen and
+// highlightClose and wraps the marked matches in <mark>, so the result is
+// safe to insert into a page as is.
+func escapeHighlight(s string) string {
+	return markReplacer.Replace(html.EscapeString(s))
+}
+
+// ftsQuery turns search terms into an FTS5 expression: every term becomes a
+// quoted prefix term and all terms must match. Terms hold only letters and
+// digits, so user input can never inject FTS5 operators.
+func ftsQuery(terms []string) string {
+	quoted := make([]string, len(terms))
+	for i, t := range terms {
+		quoted[i] = `"` + t + `"*`
+	}
+	return strings.Join(quoted, " ")
+}
+
+func (s *server) searchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	terms := searchTerms(q.Get("q"))
+	if len(terms) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "q must contain at least one word")
+		return
+	}
+
+	limit := defaultPageSize
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxPageSize {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxPageSize))
+			return
+		}
+		limit = n
+	}
+
+	offset := 0
+	if v := q.Get("cursor"); v != "" {
+		var c searchCursor
+		b, err := base64.RawURLEncoding.DecodeString(v)
+		if err == nil {
+			err = json.Unmarshal(b, &c)
+		}
+		if err != nil || c.Offset < 0 {
+			writeProblem(w, r, http.StatusBadRequest, "invalid cursor")
+			return
+		}
+		if c.Query != q.Get("q") {
+			writeProblem(w, r, http.StatusBadRequest, "cursor was issued for a different query")
+			return
+		}
+		offset = c.Offset
+	}
+
+	hits, total, err := usersFor(r).Search(r.Context(), terms, limit+1, offset)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	page := searchPage{Data: hits, Total: total}
+	if len(hits) > limit {
+		page.Data = hits[:limit]
+		b, _ := json.Marshal(searchCursor{Query: q.Get("q"), Offset: offset + limit})
+		next := base64.RawURLEncoding.EncodeToString(b)
+		page.NextCursor = &next
+	}
+
+	writeJSON(w, http.StatusOK, page)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	errUserNotFound       = errors.New("user not found")
+	errUserNotDeleted     = errors.New("user is not deleted")
+	errPreconditionFailed = errors.New("precondition failed")
+	errEmailTaken         = errors.New("email is already taken")
+)
+
+// UserRepository is the data layer behind the user handlers: the users
+// themselves, their audit history and change feed, and their credentials.
+// sqliteUserRepository is the one the server runs on; memoryUserRepository
+// keeps everything in process and behaves the same, which makes handlers
+// usable without a database file.
+//
+// Writes fail with errUserNotFound for missing or deleted users,
+// errPreconditionFailed when ifMatch is set and does not match the user's
+// ETag, and errEmailTaken when another active user has the email. Every
+// write to a user records an audit entry and a change event atomically with
+// it.
+type UserRepository interface {
+	// List returns the users matching p, up to p.limit+1 of them so the
+	// caller can tell whether another page follows, and the total number of
+	// matches ignoring the cursor.
+	List(ctx context.Context, p listParams) ([]*user, int64, error)
+	// Search returns active users matching every term as a word prefix, best
+	// match first, and the total number of matches.
+	Search(ctx context.Context, terms []string, limit, offset int) ([]*searchHit, int64, error)
+	Get(ctx context.Context, id int64, includeDeleted bool) (*user, error)
+	// GetByEmail finds an active user by email, ignoring case.
+	GetByEmail(ctx context.Context, email string) (*user, error)
+	Create(ctx context.Context, u user) (*user, error)
+	// Update calls change with a copy of the active user and stores the name
+	// and email it leaves behind. When both are left as they were nothing is
+	// written: the version stays and no audit entry is recorded. An error
+	// from change aborts the update and is returned as is.
+	Update(ctx context.Context, id int64, ifMatch string, change func(u *user) error) (*user, error)
+	// Delete soft-deletes an active user.
+	Delete(ctx context.Context, id int64, ifMatch string) error
+	// Restore undoes Delete, failing with errUserNotDeleted for active users.
+	Restore(ctx context.Context, id int64, ifMatch string) (*user, error)
+	// History lists the audit entries of a user, deleted or not, oldest
+	// first.
+	History(ctx context.Context, id int64) ([]*auditEntry, error)
+
+	// Import runs fn with an insert function whose users are created
+	// together: they are stored only if fn returns commit true and no
+	// error. insert fails with errEmailTaken without affecting the others.
+	// fn runs while the write lock is held, so it must not wait on the
+	// client.
+	Import(ctx context.Context, fn func(insert func(u user) error) (commit bool, err error)) error
+	// Export calls fn for every user in ID order, stopping at the first
+	// error.
+	Export(ctx context.Context, includeDeleted bool, fn func(u *user) error) error
+
+	// Events returns up to limit change events with an ID above afterID.
+	Events(ctx context.Context, afterID int64, limit int) ([]userEvent, error)
+	// LastEventID returns the ID of the newest change event, or 0.
+	LastEventID(ctx context.Context) (int64, error)
+
+	// LoginState returns the password hash and lockout of an active user,
+	// found by email ignoring case.
+	LoginState(ctx context.Context, email string) (*loginState, error)
+	// PasswordHash returns the password hash of a user, or "" if none is
+	// set.
+	PasswordHash(ctx context.Context, id int64) (string, error)
+	// RecordFailedLogin counts a wrong password, locking the user until
+	// lockUntil when it is the maxFailures-th in a row.
+	RecordFailedLogin(ctx context.Context, id int64, maxFailures int, lockUntil time.Time) error
+	// CreateSession stores a session, resets the failed login count and
+	// drops expired sessions. It returns the user the session belongs to.
+	CreateSession(ctx context.Context, userID int64, tokenHash string, now, expiresAt time.Time) (*user, error)
+	// FindSession returns the user of an unexpired session of an active
+	// user, or errInvalidSession.
+	FindSession(ctx context.Context, tokenHash string, now time.Time) (int64, error)
+	DeleteSession(ctx context.Context, tokenHash string) error
+	// ChangePassword stores a new hash and ends every session of the user
+	// except keepSession.
+	ChangePassword(ctx context.Context, id int64, hash, keepSession string) error
+	// SetPassword stores a new hash for an active user, clears a lockout
+	// and ends all of the user's sessions.
+	SetPassword(ctx context.Context, id int64, hash string) error
+	// CreatePasswordReset stores a reset token, replacing any earlier one of
+	// the user.
+	CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, now, expiresAt time.Time) error
+	// ResetPassword uses up an unexpired reset token and sets the password
+	// like SetPassword. It fails with errInvalidResetToken if the token is
+	// unknown, used or expired.
+	ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) error
+}
+
+// loginState is what a login needs to know about a user.
+type loginState struct {
+	UserID       int64
+	PasswordHash string
+	LockedUntil  *time.Time
+}
+
+// checkIfMatch fails with errPreconditionFailed when an If-Match header is
+// given and does not list the current version of u.
+func checkIfMatch(u *user, ifMatch string) error {
+	if ifMatch != "" && !etagMatches(ifMatch, userETag(u.Version), false) {
+		return errPreconditionFailed
+	}
+	return nil
+}
@@ -0,0 +1,683 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// memoryUserRepository is a UserRepository that keeps everything in process.
+// It follows the SQLite schema closely: emails are unique among active users
+// ignoring case, name and email filters are case-insensitive prefixes, and
+// sorting compares bytes. Search ranks by how many words matched rather
+// than by BM25, so ranks differ from SQLite while the set of hits does not.
+type memoryUserRepository struct {
+	mu     sync.Mutex
+	events *eventBroker
+
+	users    map[int64]*memoryUser
+	lastID   int64
+	audit    []*auditEntry
+	feed     []userEvent
+	sessions map[string]memorySession
+	resets   map[string]*memoryReset
+}
+
+type memoryUser struct {
+	user
+	passwordHash string
+	failedLogins int
+	lockedUntil  *time.Time
+}
+
+type memorySession struct {
+	userID    int64
+	expiresAt time.Time
+}
+
+type memoryReset struct {
+	userID    int64
+	expiresAt time.Time
+	used      bool
+}
+
+func newMemoryUserRepository(events *eventBroker) *memoryUserRepository {
+	return &memoryUserRepository{
+		events:   events,
+		users:    map[int64]*memoryUser{},
+		sessions: map[string]memorySession{},
+		resets:   map[string]*memoryReset{},
+	}
+}
+
+// copyUser returns a copy of u that shares nothing with the stored user.
+func copyUser(u user) *user {
+	if u.DeletedAt != nil {
+		deletedAt := *u.DeletedAt
+		u.DeletedAt = &deletedAt
+	}
+	return &u
+}
+
+// activeUser returns the stored user with the given ID unless it is missing
+// or deleted.
+func (repo *memoryUserRepository) activeUser(id int64) (*memoryUser, error) {
+	mu, ok := repo.users[id]
+	if !ok || mu.DeletedAt != nil {
+		return nil, errUserNotFound
+	}
+	return mu, nil
+}
+
+func (repo *memoryUserRepository) emailTaken(email string, exceptID int64) bool {
+	for id, mu := range repo.users {
+		if id != exceptID && mu.DeletedAt == nil && strings.EqualFold(mu.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// record appends the audit entry and change event of a write.
+func (repo *memoryUserRepository) record(userID int64, action string, before, after *user) error {
+	beforeJSON, err := memorySnapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := memorySnapshot(after)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	repo.audit = append(repo.audit, &auditEntry{
+		ID:        int64(len(repo.audit) + 1),
+		UserID:    userID,
+		Action:    action,
+		Before:    beforeJSON,
+		After:     afterJSON,
+		CreatedAt: now,
+	})
+	repo.feed = append(repo.feed, userEvent{
+		ID:   int64(len(repo.feed) + 1),
+		Type: auditEventTypes[action],
+		Data: string(afterJSON),
+	})
+	return nil
+}
+
+func memorySnapshot(u *user) (json.RawMessage, error) {
+	if u == nil {
+		return json.RawMessage("null"), nil
+	}
+	return json.Marshal(u)
+}
+
+func (repo *memoryUserRepository) List(ctx context.Context, p listParams) ([]*user, int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var matches []*user
+	for _, mu := range repo.users {
+		if mu.DeletedAt != nil && !p.includeDeleted {
+			continue
+		}
+		if !hasPrefixFold(mu.Name, p.namePrefix) || !hasPrefixFold(mu.Email, p.emailPrefix) {
+			continue
+		}
+		matches = append(matches, copyUser(mu.user))
+	}
+	total := int64(len(matches))
+
+	sortKey := func(u *user) string {
+		switch p.column {
+		case "name":
+			return u.Name
+		case "email":
+			return u.Email
+		}
+		return ""
+	}
+	// compare orders users by the sort column, then by ID, honoring the
+	// direction of the sort.
+	compare := func(aKey string, aID int64, bKey string, bID int64) int {
+		c := strings.Compare(aKey, bKey)
+		if c == 0 {
+			c = int(aID - bID)
+		}
+		if p.desc {
+			return -c
+		}
+		return c
+	}
+
+	slices.SortFunc(matches, func(a, b *user) int {
+		return compare(sortKey(a), a.ID, sortKey(b), b.ID)
+	})
+
+	users := []*user{}
+	for _, u := range matches {
+		if p.after != nil && compare(sortKey(u), u.ID, p.after.Value, p.after.ID) <= 0 {
+			continue
+		}
+		users = append(users, u)
+		if len(users) > p.limit {
+			break
+		}
+	}
+
+	return users, total, nil
+}
+
+// hasPrefixFold matches like the LIKE filters of SQLite, which ignore the
+// case of ASCII letters only.
+func hasPrefixFold(s, prefix string) bool {
+	if len(s) < len(prefix) {
+		return false
+	}
+	for i := 0; i < len(prefix); i++ {
+		if asciiLower(s[i]) != asciiLower(prefix[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func asciiLower(c byte) byte {
+	if 'A' <= c && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
+
+func (repo *memoryUserRepository) Search(ctx context.Context, terms []string, limit, offset int) ([]*searchHit, int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	var hits []*searchHit
+	for _, mu := range repo.users {
+		if mu.DeletedAt != nil || !matchesAllTerms(terms, mu.Name, mu.Email) {
+			continue
+		}
+
+		h := &searchHit{user: *copyUser(mu.user)}
+		var nameHits, emailHits int
+		h.Highlight.Name, nameHits = highlightTerms(mu.Name, terms)
+		h.Highlight.Email, emailHits = highlightTerms(mu.Email, terms)
+		// Weighted like the bm25 call of the SQLite search: a name match
+		// counts twice as much as an email match, and lower ranks are
+		// better.
+		h.Rank = -float64(nameHits*10 + emailHits*5)
+		hits = append(hits, h)
+	}
+
+	sort.Slice(hits, func(i, j int) bool {
+		if hits[i].Rank != hits[j].Rank {
+			return hits[i].Rank < hits[j].Rank
+		}
+		return hits[i].ID < hits[j].ID
+	})
+
+	total := int64(len(hits))
+	if offset > len(hits) {
+		offset = len(hits)
+	}
+	hits = hits[offset:]
+	if len(hits) > limit {
+		hits = hits[:limit]
+	}
+
+	return append([]*searchHit{}, hits...), total, nil
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func matchesTerm(word string, terms []string) bool {
+	for _, t := range terms {
+		if len(word) >= len(t) && strings.EqualFold(word[:len(t)], t) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAllTerms(terms []string, fields ...string) bool {
+	for _, t := range terms {
+		found := false
+		for _, f := range fields {
+			for _, word := range strings.FieldsFunc(f, func(r rune) bool { return !isWordRune(r) }) {
+				if matchesTerm(word, []string{t}) {
+					found = true
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// highlightTerms wraps every word of text that starts with one of the terms
+// in <mark> tags, like the highlight function of FTS5 in the SQLite search,
+// escapes the rest for HTML and reports how many words it wrapped.
+func highlightTerms(text string, terms []string) (string, int) {
+	var b strings.Builder
+	hits := 0
+	for i := 0; i < len(text); {
+		j := i
+		for j < len(text) {
+			r, n := utf8.DecodeRuneInString(text[j:])
+			if !isWordRune(r) {
+				break
+			}
+			j += n
+		}
+
+		if j == i {
+			_, n := utf8.DecodeRuneInString(text[i:])
+			b.WriteString(text[i : i+n])
+			i += n
+			continue
+		}
+
+		if word := text[i:j]; matchesTerm(word, terms) {
+			b.WriteString(highlightOpen + word + highlightClose)
+			hits++
+		} else {
+			b.WriteString(word)
+		}
+		i = j
+	}
+	return escapeHighlight(b.String()), hits
+}
+
+func (repo *memoryUserRepository) Get(ctx context.Context, id int64, includeDeleted bool) (*user, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	mu, ok := repo.users[id]
+	if !ok || (mu.DeletedAt != nil && !includeDeleted) {
+		return nil, errUserNotFound
+	}
+	return copyUser(mu.user), nil
+}
+
+func (repo *memoryUserRepository) GetByEmail(ctx context.Context, email string) (*user, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, mu := range repo.users {
+		if mu.DeletedAt == nil && strings.EqualFold(mu.Email, email) {
+			return copyUser(mu.user), nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func (repo *memoryUserRepository) Create(ctx context.Context, u user) (*user, error) {
+	repo.mu.Lock()
+	created, err := repo.insert(u)
+	repo.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	repo.events.notify()
+	return created, nil
+}
+
+func (repo *memoryUserRepository) insert(u user) (*user, error) {
+	if repo.emailTaken(u.Email, 0) {
+		return nil, errEmailTaken
+	}
+
+	repo.lastID++
+	mu := &memoryUser{user: user{ID: repo.lastID, Name: u.Name, Email: u.Email, Version: 1}}
+	repo.users[mu.ID] = mu
+
+	created := copyUser(mu.user)
+	return created, repo.record(mu.ID, auditCreate, nil, created)
+}
+
+// write runs fn under the lock and wakes the change feed if it succeeds.
+func (repo *memoryUserRepository) write(fn func() error) error {
+	repo.mu.Lock()
+	err := fn()
+	repo.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	repo.events.notify()
+	return nil
+}
+
+func (repo *memoryUserRepository) Update(ctx context.Context, id int64, ifMatch string, change func(u *user) error) (*user, error) {
+	var updated *user
+	err := repo.write(func() error {
+		mu, err := repo.activeUser(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(&mu.user, ifMatch); err != nil {
+			return err
+		}
+
+		before := copyUser(mu.user)
+		u := *copyUser(mu.user)
+		if err := change(&u); err != nil {
+			return err
+		}
+		if u.Name == before.Name && u.Email == before.Email {
+			updated = before
+			return nil
+		}
+		if repo.emailTaken(u.Email, id) {
+			return errEmailTaken
+		}
+
+		mu.Name, mu.Email = u.Name, u.Email
+		mu.Version++
+		updated = copyUser(mu.user)
+		return repo.record(id, auditUpdate, before, updated)
+	})
+	return updated, err
+}
+
+func (repo *memoryUserRepository) Delete(ctx context.Context, id int64, ifMatch string) error {
+	return repo.write(func() error {
+		mu, err := repo.activeUser(id)
+		if err != nil {
+			return err
+		}
+		if err := checkIfMatch(&mu.user, ifMatch); err != nil {
+			return err
+		}
+
+		before := copyUser(mu.user)
+		now := time.Now().UTC()
+		mu.DeletedAt = &now
+		mu.Version++
+		return repo.record(id, auditDelete, before, copyUser(mu.user))
+	})
+}
+
+func (repo *memoryUserRepository) Restore(ctx context.Context, id int64, ifMatch string) (*user, error) {
+	var restored *user
+	err := repo.write(func() error {
+		mu, ok := repo.users[id]
+		if !ok {
+			return errUserNotFound
+		}
+		if mu.DeletedAt == nil {
+			return errUserNotDeleted
+		}
+		if err := checkIfMatch(&mu.user, ifMatch); err != nil {
+			return err
+		}
+		if repo.emailTaken(mu.Email, id) {
+			return errEmailTaken
+		}
+
+		before := copyUser(mu.user)
+		mu.DeletedAt = nil
+		mu.Version++
+		restored = copyUser(mu.user)
+		return repo.record(id, auditRestore, before, restored)
+	})
+	return restored, err
+}
+
+func (repo *memoryUserRepository) History(ctx context.Context, id int64) ([]*auditEntry, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	if _, ok := repo.users[id]; !ok {
+		return nil, errUserNotFound
+	}
+
+	entries := []*auditEntry{}
+	for _, e := range repo.audit {
+		if e.UserID == id {
+			entry := *e
+			entries = append(entries, &entry)
+		}
+	}
+	return entries, nil
+}
+
+// Import holds the lock for the whole import, like the write transaction of
+// the SQLite import, and undoes its inserts unless fn commits.
+func (repo *memoryUserRepository) Import(ctx context.Context, fn func(insert func(u user) error) (bool, error)) error {
+	repo.mu.Lock()
+
+	lastID, auditLen, feedLen := repo.lastID, len(repo.audit), len(repo.feed)
+	insert := func(u user) error {
+		_, err := repo.insert(u)
+		return err
+	}
+
+	commit, err := fn(insert)
+	if err != nil || !commit {
+		for id := lastID + 1; id <= repo.lastID; id++ {
+			delete(repo.users, id)
+		}
+		repo.lastID, repo.audit, repo.feed = lastID, repo.audit[:auditLen], repo.feed[:feedLen]
+		repo.mu.Unlock()
+		return err
+	}
+
+	repo.mu.Unlock()
+	repo.events.notify()
+	return nil
+}
+
+func (repo *memoryUserRepository) Export(ctx context.Context, includeDeleted bool, fn func(u *user) error) error {
+	repo.mu.Lock()
+	var users []*user
+	for _, mu := range repo.users {
+		if mu.DeletedAt == nil || includeDeleted {
+			users = append(users, copyUser(mu.user))
+		}
+	}
+	repo.mu.Unlock()
+
+	slices.SortFunc(users, func(a, b *user) int { return int(a.ID - b.ID) })
+	for _, u := range users {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) Events(ctx context.Context, afterID int64, limit int) ([]userEvent, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	// Event IDs are the positions in feed, starting at 1.
+	if afterID >= int64(len(repo.feed)) {
+		return nil, nil
+	}
+	events := repo.feed[afterID:]
+	if len(events) > limit {
+		events = events[:limit]
+	}
+	return append([]userEvent{}, events...), nil
+}
+
+func (repo *memoryUserRepository) LastEventID(ctx context.Context) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return int64(len(repo.feed)), nil
+}
+
+func (repo *memoryUserRepository) LoginState(ctx context.Context, email string) (*loginState, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for _, mu := range repo.users {
+		if mu.DeletedAt == nil && strings.EqualFold(mu.Email, email) {
+			st := &loginState{UserID: mu.ID, PasswordHash: mu.passwordHash}
+			if mu.lockedUntil != nil {
+				lockedUntil := *mu.lockedUntil
+				st.LockedUntil = &lockedUntil
+			}
+			return st, nil
+		}
+	}
+	return nil, errUserNotFound
+}
+
+func (repo *memoryUserRepository) PasswordHash(ctx context.Context, id int64) (string, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	mu, ok := repo.users[id]
+	if !ok {
+		return "", errUserNotFound
+	}
+	return mu.passwordHash, nil
+}
+
+func (repo *memoryUserRepository) RecordFailedLogin(ctx context.Context, id int64, maxFailures int, lockUntil time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	mu, ok := repo.users[id]
+	if !ok {
+		return nil
+	}
+	mu.failedLogins++
+	if mu.failedLogins >= maxFailures {
+		mu.failedLogins = 0
+		mu.lockedUntil = &lockUntil
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) CreateSession(ctx context.Context, userID int64, tokenHash string, now, expiresAt time.Time) (*user, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	mu, err := repo.activeUser(userID)
+	if err != nil {
+		return nil, err
+	}
+	mu.failedLogins = 0
+	mu.lockedUntil = nil
+
+	for hash, sess := range repo.sessions {
+		if sess.expiresAt.Before(now) {
+			delete(repo.sessions, hash)
+		}
+	}
+	repo.sessions[tokenHash] = memorySession{userID: userID, expiresAt: expiresAt}
+
+	return copyUser(mu.user), nil
+}
+
+func (repo *memoryUserRepository) FindSession(ctx context.Context, tokenHash string, now time.Time) (int64, error) {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	sess, ok := repo.sessions[tokenHash]
+	if !ok || !sess.expiresAt.After(now) {
+		return 0, errInvalidSession
+	}
+	if _, err := repo.activeUser(sess.userID); err != nil {
+		return 0, errInvalidSession
+	}
+	return sess.userID, nil
+}
+
+func (repo *memoryUserRepository) DeleteSession(ctx context.Context, tokenHash string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	delete(repo.sessions, tokenHash)
+	return nil
+}
+
+func (repo *memoryUserRepository) ChangePassword(ctx context.Context, id int64, hash, keepSession string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	mu, ok := repo.users[id]
+	if !ok {
+		return nil
+	}
+	mu.passwordHash = hash
+	for tokenHash, sess := range repo.sessions {
+		if sess.userID == id && tokenHash != keepSession {
+			delete(repo.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) SetPassword(ctx context.Context, id int64, hash string) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	return repo.setPassword(id, hash)
+}
+
+func (repo *memoryUserRepository) setPassword(id int64, hash string) error {
+	mu, err := repo.activeUser(id)
+	if err != nil {
+		return err
+	}
+
+	mu.passwordHash = hash
+	mu.failedLogins = 0
+	mu.lockedUntil = nil
+	for tokenHash, sess := range repo.sessions {
+		if sess.userID == id {
+			delete(repo.sessions, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (repo *memoryUserRepository) CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, now, expiresAt time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	for hash, reset := range repo.resets {
+		if reset.userID == userID || reset.expiresAt.Before(now) {
+			delete(repo.resets, hash)
+		}
+	}
+	repo.resets[tokenHash] = &memoryReset{userID: userID, expiresAt: expiresAt}
+	return nil
+}
+
+func (repo *memoryUserRepository) ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) error {
+	repo.mu.Lock()
+	defer repo.mu.Unlock()
+
+	reset, ok := repo.resets[tokenHash]
+	if !ok || reset.used || !reset.expiresAt.After(now) {
+		return errInvalidResetToken
+	}
+	if _, err := repo.activeUser(reset.userID); err != nil {
+		return errInvalidResetToken
+	}
+
+	reset.used = true
+	return repo.setPassword(reset.userID, hash)
+}
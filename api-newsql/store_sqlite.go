@@ -0,0 +1,583 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+const userColumns = "id, name, email, version, deleted_at"
+
+// rowQueryer is satisfied by both *sql.DB and *sql.Tx.
+type rowQueryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+// sqliteUserRepository is the UserRepository backed by the users database.
+// It wakes the change feed through events after every committed write.
+type sqliteUserRepository struct {
+	db     *sql.DB
+	events *eventBroker
+}
+
+func newSQLiteUserRepository(db *sql.DB, events *eventBroker) *sqliteUserRepository {
+	return &sqliteUserRepository{db: db, events: events}
+}
+
+// write runs fn in a transaction and wakes the change feed once it commits.
+func (repo *sqliteUserRepository) write(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	if err := runInTx(ctx, repo.db, fn); err != nil {
+		if isUniqueViolation(err) {
+			return errEmailTaken
+		}
+		return err
+	}
+	repo.events.notify()
+	return nil
+}
+
+func scanUser(row rowScanner) (*user, error) {
+	var u user
+	var deletedAt sql.NullTime
+	if err := row.Scan(&u.ID, &u.Name, &u.Email, &u.Version, &deletedAt); err != nil {
+		return nil, err
+	}
+	if deletedAt.Valid {
+		u.DeletedAt = &deletedAt.Time
+	}
+
+	return &u, nil
+}
+
+// findUser loads a user by ID. Soft-deleted users are reported as missing
+// unless includeDeleted is set.
+func findUser(q rowQueryer, id int64, includeDeleted bool) (*user, error) {
+	query := "SELECT " + userColumns + " FROM users WHERE id = ?"
+	if !includeDeleted {
+		query += " AND deleted_at IS NULL"
+	}
+
+	u, err := scanUser(q.QueryRow(query, id))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// lockUser loads the active user about to be written and checks ifMatch
+// against it. Callers run it inside the write transaction so the user
+// cannot change between the check and the write.
+func lockUser(tx *sql.Tx, id int64, ifMatch string) (*user, error) {
+	u, err := findUser(tx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkIfMatch(u, ifMatch); err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// recordAudit stores the before and after snapshots of a write and the
+// matching change event. It must run in the same transaction as the write it
+// describes.
+func recordAudit(tx *sql.Tx, userID int64, action string, before, after *user) error {
+	beforeJSON, err := auditSnapshot(before)
+	if err != nil {
+		return err
+	}
+	afterJSON, err := auditSnapshot(after)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	_, err = tx.Exec("INSERT INTO user_audit (user_id, action, before, after, created_at) VALUES (?, ?, ?, ?, ?)",
+		userID, action, beforeJSON, afterJSON, now)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("INSERT INTO user_events (type, user_id, data, created_at) VALUES (?, ?, ?, ?)",
+		auditEventTypes[action], userID, afterJSON, now)
+	return err
+}
+
+func auditSnapshot(u *user) (any, error) {
+	if u == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(u)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (repo *sqliteUserRepository) List(ctx context.Context, p listParams) ([]*user, int64, error) {
+	query, args := p.pageSQL()
+	rows, err := repo.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []*user{}
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, u)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	countSQL, countArgs := p.countSQL()
+	if err := repo.db.QueryRowContext(ctx, countSQL, countArgs...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	return users, total, nil
+}
+
+func (repo *sqliteUserRepository) Search(ctx context.Context, terms []string, limit, offset int) ([]*searchHit, int64, error) {
+	match := ftsQuery(terms)
+
+	rows, err := repo.db.QueryContext(ctx, `SELECT u.id, u.name, u.email, u.version,
+			bm25(users_fts, 10.0, 5.0) AS rank,
+			highlight(users_fts, 0, char(2), char(3)),
+			highlight(users_fts, 1, char(2), char(3))
+		FROM users_fts
+		JOIN users u ON u.id = users_fts.rowid
+		WHERE users_fts MATCH ? AND u.deleted_at IS NULL
+		ORDER BY rank, u.id
+		LIMIT ? OFFSET ?`, match, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	hits := []*searchHit{}
+	for rows.Next() {
+		var h searchHit
+		err := rows.Scan(&h.ID, &h.Name, &h.Email, &h.Version,
+			&h.Rank, &h.Highlight.Name, &h.Highlight.Email)
+		if err != nil {
+			return nil, 0, err
+		}
+		h.Highlight.Name = escapeHighlight(h.Highlight.Name)
+		h.Highlight.Email = escapeHighlight(h.Highlight.Email)
+		hits = append(hits, &h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var total int64
+	err = repo.db.QueryRowContext(ctx, `SELECT COUNT(*)
+		FROM users_fts
+		JOIN users u ON u.id = users_fts.rowid
+		WHERE users_fts MATCH ? AND u.deleted_at IS NULL`, match).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return hits, total, nil
+}
+
+func (repo *sqliteUserRepository) Get(ctx context.Context, id int64, includeDeleted bool) (*user, error) {
+	return findUser(repo.db, id, includeDeleted)
+}
+
+func (repo *sqliteUserRepository) GetByEmail(ctx context.Context, email string) (*user, error) {
+	u, err := scanUser(repo.db.QueryRowContext(ctx, "SELECT "+userColumns+" FROM users WHERE email = ? COLLATE NOCASE AND deleted_at IS NULL", email))
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+func (repo *sqliteUserRepository) Create(ctx context.Context, u user) (*user, error) {
+	var created *user
+	err := repo.write(ctx, func(tx *sql.Tx) error {
+		var err error
+		created, err = insertUser(tx, u)
+		return err
+	})
+	return created, err
+}
+
+func insertUser(tx *sql.Tx, u user) (*user, error) {
+	result, err := tx.Exec("INSERT INTO users (name, email) VALUES (?, ?)", u.Name, u.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	created, err := findUser(tx, id, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return created, recordAudit(tx, id, auditCreate, nil, created)
+}
+
+func (repo *sqliteUserRepository) Update(ctx context.Context, id int64, ifMatch string, change func(u *user) error) (*user, error) {
+	var updated *user
+	err := repo.write(ctx, func(tx *sql.Tx) error {
+		before, err := lockUser(tx, id, ifMatch)
+		if err != nil {
+			return err
+		}
+
+		u := *before
+		if err := change(&u); err != nil {
+			return err
+		}
+		if u.Name == before.Name && u.Email == before.Email {
+			updated = before
+			return nil
+		}
+
+		updateSQL := "UPDATE users SET name = ?, email = ?, version = version + 1 WHERE id = ?"
+		if _, err := tx.Exec(updateSQL, u.Name, u.Email, id); err != nil {
+			return err
+		}
+		if updated, err = findUser(tx, id, false); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, id, auditUpdate, before, updated)
+	})
+	return updated, err
+}
+
+func (repo *sqliteUserRepository) Delete(ctx context.Context, id int64, ifMatch string) error {
+	return repo.write(ctx, func(tx *sql.Tx) error {
+		before, err := lockUser(tx, id, ifMatch)
+		if err != nil {
+			return err
+		}
+
+		deleteSQL := "UPDATE users SET deleted_at = ?, version = version + 1 WHERE id = ?"
+		if _, err := tx.Exec(deleteSQL, time.Now().UTC(), id); err != nil {
+			return err
+		}
+		after, err := findUser(tx, id, true)
+		if err != nil {
+			return err
+		}
+
+		return recordAudit(tx, id, auditDelete, before, after)
+	})
+}
+
+func (repo *sqliteUserRepository) Restore(ctx context.Context, id int64, ifMatch string) (*user, error) {
+	var restored *user
+	err := repo.write(ctx, func(tx *sql.Tx) error {
+		before, err := findUser(tx, id, true)
+		if err != nil {
+			return err
+		}
+		if before.DeletedAt == nil {
+			return errUserNotDeleted
+		}
+		if err := checkIfMatch(before, ifMatch); err != nil {
+			return err
+		}
+
+		restoreSQL := "UPDATE users SET deleted_at = NULL, version = version + 1 WHERE id = ?"
+		if _, err := tx.Exec(restoreSQL, id); err != nil {
+			return err
+		}
+		if restored, err = findUser(tx, id, false); err != nil {
+			return err
+		}
+
+		return recordAudit(tx, id, auditRestore, before, restored)
+	})
+	return restored, err
+}
+
+func (repo *sqliteUserRepository) History(ctx context.Context, id int64) ([]*auditEntry, error) {
+	if _, err := findUser(repo.db, id, true); err != nil {
+		return nil, err
+	}
+
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, user_id, action, before, after, created_at FROM user_audit WHERE user_id = ? ORDER BY id", id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*auditEntry{}
+	for rows.Next() {
+		var e auditEntry
+		var before, after sql.NullString
+		if err := rows.Scan(&e.ID, &e.UserID, &e.Action, &before, &after, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		e.Before = rawJSONOrNull(before)
+		e.After = rawJSONOrNull(after)
+		entries = append(entries, &e)
+	}
+
+	return entries, rows.Err()
+}
+
+// Import runs the whole import in one transaction and every insert inside
+// its own savepoint, so a failing row is undone without aborting the rest.
+func (repo *sqliteUserRepository) Import(ctx context.Context, fn func(insert func(u user) error) (bool, error)) error {
+	tx, err := repo.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	insert := func(u user) error {
+		if _, err := tx.Exec("SAVEPOINT import_row"); err != nil {
+			return err
+		}
+
+		_, err := insertUser(tx, u)
+		if err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO import_row"); rbErr != nil {
+				return rbErr
+			}
+		}
+		if _, relErr := tx.Exec("RELEASE import_row"); relErr != nil {
+			return relErr
+		}
+
+		if isUniqueViolation(err) {
+			return errEmailTaken
+		}
+		return err
+	}
+
+	commit, err := fn(insert)
+	if err != nil || !commit {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	repo.events.notify()
+	return nil
+}
+
+func (repo *sqliteUserRepository) Export(ctx context.Context, includeDeleted bool, fn func(u *user) error) error {
+	query := "SELECT " + userColumns + " FROM users"
+	if !includeDeleted {
+		query += " WHERE deleted_at IS NULL"
+	}
+	query += " ORDER BY id"
+
+	rows, err := repo.db.QueryContext(ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := scanUser(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+func (repo *sqliteUserRepository) Events(ctx context.Context, afterID int64, limit int) ([]userEvent, error) {
+	rows, err := repo.db.QueryContext(ctx, "SELECT id, type, data FROM user_events WHERE id > ? ORDER BY id LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var events []userEvent
+	for rows.Next() {
+		var e userEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.Data); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (repo *sqliteUserRepository) LastEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := repo.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM user_events").Scan(&id)
+	return id, err
+}
+
+func (repo *sqliteUserRepository) LoginState(ctx context.Context, email string) (*loginState, error) {
+	var st loginState
+	var hash sql.NullString
+	var lockedUntil sql.NullTime
+	err := repo.db.QueryRowContext(ctx, "SELECT id, password_hash, locked_until FROM users WHERE email = ? COLLATE NOCASE AND deleted_at IS NULL", email).
+		Scan(&st.UserID, &hash, &lockedUntil)
+	if err == sql.ErrNoRows {
+		return nil, errUserNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	st.PasswordHash = hash.String
+	if lockedUntil.Valid {
+		st.LockedUntil = &lockedUntil.Time
+	}
+	return &st, nil
+}
+
+func (repo *sqliteUserRepository) PasswordHash(ctx context.Context, id int64) (string, error) {
+	var hash sql.NullString
+	err := repo.db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = ?", id).Scan(&hash)
+	if err == sql.ErrNoRows {
+		return "", errUserNotFound
+	}
+	return hash.String, err
+}
+
+func (repo *sqliteUserRepository) RecordFailedLogin(ctx context.Context, id int64, maxFailures int, lockUntil time.Time) error {
+	// The lock starts on the failure that reaches the limit, and the counter
+	// starts over once it is set.
+	_, err := repo.db.ExecContext(ctx, `UPDATE users SET
+		failed_logins = CASE WHEN failed_logins + 1 >= ? THEN 0 ELSE failed_logins + 1 END,
+		locked_until = CASE WHEN failed_logins + 1 >= ? THEN ? ELSE locked_until END
+		WHERE id = ?`, maxFailures, maxFailures, lockUntil, id)
+	return err
+}
+
+func (repo *sqliteUserRepository) CreateSession(ctx context.Context, userID int64, tokenHash string, now, expiresAt time.Time) (*user, error) {
+	var u *user
+	err := runInTx(ctx, repo.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE users SET failed_logins = 0, locked_until = NULL WHERE id = ?", userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE expires_at < ?", now); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO sessions (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+			tokenHash, userID, now, expiresAt)
+		if err != nil {
+			return err
+		}
+		u, err = findUser(tx, userID, false)
+		return err
+	})
+	return u, err
+}
+
+func (repo *sqliteUserRepository) FindSession(ctx context.Context, tokenHash string, now time.Time) (int64, error) {
+	var userID int64
+	err := repo.db.QueryRowContext(ctx, `SELECT s.user_id FROM sessions s
+		JOIN users u ON u.id = s.user_id
+		WHERE s.token_hash = ? AND s.expires_at > ? AND u.deleted_at IS NULL`, tokenHash, now).
+		Scan(&userID)
+	if err == sql.ErrNoRows {
+		return 0, errInvalidSession
+	}
+	return userID, err
+}
+
+func (repo *sqliteUserRepository) DeleteSession(ctx context.Context, tokenHash string) error {
+	_, err := repo.db.ExecContext(ctx, "DELETE FROM sessions WHERE token_hash = ?", tokenHash)
+	return err
+}
+
+func (repo *sqliteUserRepository) ChangePassword(ctx context.Context, id int64, hash, keepSession string) error {
+	return runInTx(ctx, repo.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec("DELETE FROM sessions WHERE user_id = ? AND token_hash <> ?", id, keepSession)
+		return err
+	})
+}
+
+func (repo *sqliteUserRepository) SetPassword(ctx context.Context, id int64, hash string) error {
+	return runInTx(ctx, repo.db, func(tx *sql.Tx) error {
+		return setPassword(tx, id, hash)
+	})
+}
+
+// setPassword stores a new password hash for an active user, clears any
+// lockout and ends the user's sessions.
+func setPassword(tx *sql.Tx, id int64, hash string) error {
+	result, err := tx.Exec("UPDATE users SET password_hash = ?, failed_logins = 0, locked_until = NULL WHERE id = ? AND deleted_at IS NULL", hash, id)
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errUserNotFound
+	}
+
+	_, err = tx.Exec("DELETE FROM sessions WHERE user_id = ?", id)
+	return err
+}
+
+func (repo *sqliteUserRepository) CreatePasswordReset(ctx context.Context, userID int64, tokenHash string, now, expiresAt time.Time) error {
+	return runInTx(ctx, repo.db, func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM password_resets WHERE user_id = ? OR expires_at < ?", userID, now); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO password_resets (token_hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)",
+			tokenHash, userID, now, expiresAt)
+		return err
+	})
+}
+
+func (repo *sqliteUserRepository) ResetPassword(ctx context.Context, tokenHash, hash string, now time.Time) error {
+	return runInTx(ctx, repo.db, func(tx *sql.Tx) error {
+		var userID int64
+		err := tx.QueryRow("SELECT user_id FROM password_resets WHERE token_hash = ? AND used_at IS NULL AND expires_at > ?", tokenHash, now).
+			Scan(&userID)
+		if err == sql.ErrNoRows {
+			return errInvalidResetToken
+		} else if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec("UPDATE password_resets SET used_at = ? WHERE token_hash = ?", now, tokenHash); err != nil {
+			return err
+		}
+
+		err = setPassword(tx, userID, hash)
+		if err == errUserNotFound {
+			return errInvalidResetToken
+		}
+		return err
+	})
+}
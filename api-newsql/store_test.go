@@ -0,0 +1,689 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a migrated database in a temporary file. Like the server,
+// which refuses to start without FTS5, the tests require the sqlite_fts5
+// build tag.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := openDB(filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := requireFTS5(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// repositories lists the UserRepository implementations every contract
+// check runs against.
+var repositories = []struct {
+	name string
+	new  func(t *testing.T) UserRepository
+}{
+	{"sqlite", func(t *testing.T) UserRepository { return newSQLiteUserRepository(newTestDB(t), newEventBroker()) }},
+	{"memory", func(t *testing.T) UserRepository { return newMemoryUserRepository(newEventBroker()) }},
+}
+
+var repositoryContract = []struct {
+	name  string
+	check func(t *testing.T, ctx context.Context, repo UserRepository)
+}{
+	{"CreateAndGet", testCreateAndGet},
+	{"DuplicateEmail", testDuplicateEmail},
+	{"ListAndCursor", testListAndCursor},
+	{"IfMatch", testIfMatch},
+	{"UpdateNoop", testUpdateNoop},
+	{"DeleteAndRestore", testDeleteAndRestore},
+	{"History", testHistory},
+	{"Search", testSearch},
+	{"SearchHighlight", testSearchHighlight},
+	{"Import", testImport},
+	{"Export", testExport},
+	{"Events", testEvents},
+	{"Sessions", testSessions},
+	{"PasswordReset", testPasswordReset},
+}
+
+func TestUserRepository(t *testing.T) {
+	for _, impl := range repositories {
+		t.Run(impl.name, func(t *testing.T) {
+			for _, c := range repositoryContract {
+				t.Run(c.name, func(t *testing.T) {
+					c.check(t, context.Background(), impl.new(t))
+				})
+			}
+		})
+	}
+}
+
+func mustCreate(t *testing.T, ctx context.Context, repo UserRepository, name, email string) *user {
+	t.Helper()
+
+	u, err := repo.Create(ctx, user{Name: name, Email: email})
+	if err != nil {
+		t.Fatalf("Create(%q): %v", email, err)
+	}
+	return u
+}
+
+func wantErr(t *testing.T, what string, err, want error) {
+	t.Helper()
+
+	if !errors.Is(err, want) {
+		t.Fatalf("%s: got error %v, want %v", what, err, want)
+	}
+}
+
+func testCreateAndGet(t *testing.T, ctx context.Context, repo UserRepository) {
+	created := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	if created.ID == 0 || created.Version != 1 || created.DeletedAt != nil {
+		t.Fatalf("Create returned %+v", created)
+	}
+
+	got, err := repo.Get(ctx, created.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *created {
+		t.Errorf("Get = %+v, want %+v", got, created)
+	}
+
+	byEmail, err := repo.GetByEmail(ctx, "ALICE@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if byEmail.ID != created.ID {
+		t.Errorf("GetByEmail found user %d, want %d", byEmail.ID, created.ID)
+	}
+
+	_, err = repo.Get(ctx, created.ID+100, false)
+	wantErr(t, "Get of a missing user", err, errUserNotFound)
+}
+
+func testDuplicateEmail(t *testing.T, ctx context.Context, repo UserRepository) {
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	bob := mustCreate(t, ctx, repo, "Bob", "bob@example.com")
+
+	_, err := repo.Create(ctx, user{Name: "Other", Email: "Alice@Example.com"})
+	wantErr(t, "Create with a taken email", err, errEmailTaken)
+
+	_, err = repo.Update(ctx, bob.ID, "", func(u *user) error {
+		u.Email = "alice@example.com"
+		return nil
+	})
+	wantErr(t, "Update to a taken email", err, errEmailTaken)
+
+	// Deleted users give up their email.
+	if err := repo.Delete(ctx, alice.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, ctx, repo, "New Alice", "alice@example.com")
+
+	_, err = repo.Restore(ctx, alice.ID, "")
+	wantErr(t, "Restore while the email is taken", err, errEmailTaken)
+}
+
+func testListAndCursor(t *testing.T, ctx context.Context, repo UserRepository) {
+	for _, name := range []string{"Carol", "alice", "Bob", "Alan", "Dave"} {
+		mustCreate(t, ctx, repo, name, name+"@example.com")
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"sort=id&limit=2", []string{"Carol", "alice", "Bob", "Alan", "Dave"}},
+		{"sort=name&limit=2", []string{"Alan", "Bob", "Carol", "Dave", "alice"}},
+		{"sort=-name&limit=3", []string{"alice", "Dave", "Carol", "Bob", "Alan"}},
+		{"name=al&limit=1", []string{"alice", "Alan"}},
+		{"email=B", []string{"Bob"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			q, _ := url.ParseQuery(tt.query)
+			p, err := parseListParams(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			for pages := 0; ; pages++ {
+				if pages > len(tt.want) {
+					t.Fatal("pagination does not end")
+				}
+
+				users, total, err := repo.List(ctx, p)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if total != int64(len(tt.want)) {
+					t.Errorf("total = %d, want %d", total, len(tt.want))
+				}
+
+				more := len(users) > p.limit
+				if more {
+					users = users[:p.limit]
+				}
+				for _, u := range users {
+					names = append(names, u.Name)
+				}
+				if !more {
+					break
+				}
+
+				c, err := decodeCursor(p.cursorAfter(users[len(users)-1]))
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.after = c
+			}
+
+			if !slices.Equal(names, tt.want) {
+				t.Errorf("got %v, want %v", names, tt.want)
+			}
+		})
+	}
+}
+
+func testIfMatch(t *testing.T, ctx context.Context, repo UserRepository) {
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	rename := func(name string) func(*user) error {
+		return func(u *user) error {
+			u.Name = name
+			return nil
+		}
+	}
+
+	_, err := repo.Update(ctx, u.ID, userETag(u.Version+1), rename("Stale"))
+	wantErr(t, "Update with a stale ETag", err, errPreconditionFailed)
+
+	updated, err := repo.Update(ctx, u.ID, userETag(u.Version), rename("Alice Smith"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if updated.Name != "Alice Smith" || updated.Version != u.Version+1 {
+		t.Errorf("Update returned %+v", updated)
+	}
+
+	_, err = repo.Update(ctx, u.ID, "*", rename("Any"))
+	if err != nil {
+		t.Errorf("Update with If-Match *: %v", err)
+	}
+
+	err = repo.Delete(ctx, u.ID, userETag(u.Version))
+	wantErr(t, "Delete with a stale ETag", err, errPreconditionFailed)
+
+	changeErr := errors.New("change failed")
+	_, err = repo.Update(ctx, u.ID, "", func(*user) error { return changeErr })
+	wantErr(t, "Update with a failing change", err, changeErr)
+
+	got, err := repo.Get(ctx, u.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Name != "Any" {
+		t.Errorf("failed updates changed the user to %+v", got)
+	}
+}
+
+// An update that leaves the name and email as they were is not a write: the
+// version, the history and the change feed stay as they are.
+func testUpdateNoop(t *testing.T, ctx context.Context, repo UserRepository) {
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	lastEvent, err := repo.LastEventID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := repo.Update(ctx, u.ID, userETag(u.Version), func(*user) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != u.Version || got.Name != u.Name {
+		t.Errorf("Update without changes returned %+v, want %+v", got, u)
+	}
+
+	history, err := repo.History(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("%d history entries, want only the creation", len(history))
+	}
+	if id, err := repo.LastEventID(ctx); err != nil || id != lastEvent {
+		t.Errorf("last event %d, want %d: %v", id, lastEvent, err)
+	}
+
+	// Changing the case of the email is a change.
+	got, err = repo.Update(ctx, u.ID, "", func(u *user) error {
+		u.Email = "Alice@example.com"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != u.Version+1 {
+		t.Errorf("version %d after changing the email, want %d", got.Version, u.Version+1)
+	}
+}
+
+func testDeleteAndRestore(t *testing.T, ctx context.Context, repo UserRepository) {
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+
+	_, err := repo.Restore(ctx, u.ID, "")
+	wantErr(t, "Restore of an active user", err, errUserNotDeleted)
+
+	if err := repo.Delete(ctx, u.ID, userETag(u.Version)); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = repo.Get(ctx, u.ID, false)
+	wantErr(t, "Get of a deleted user", err, errUserNotFound)
+	err = repo.Delete(ctx, u.ID, "")
+	wantErr(t, "Delete of a deleted user", err, errUserNotFound)
+	_, err = repo.Update(ctx, u.ID, "", func(*user) error { return nil })
+	wantErr(t, "Update of a deleted user", err, errUserNotFound)
+
+	deleted, err := repo.Get(ctx, u.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.DeletedAt == nil || deleted.Version != u.Version+1 {
+		t.Fatalf("deleted user is %+v", deleted)
+	}
+
+	users, total, err := repo.List(ctx, listParams{limit: 10, sort: "id", column: "id"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 0 || len(users) != 0 {
+		t.Errorf("List includes the deleted user: %d users, total %d", len(users), total)
+	}
+
+	_, err = repo.Restore(ctx, u.ID, userETag(u.Version))
+	wantErr(t, "Restore with a stale ETag", err, errPreconditionFailed)
+
+	restored, err := repo.Restore(ctx, u.ID, userETag(deleted.Version))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.DeletedAt != nil || restored.Version != deleted.Version+1 {
+		t.Errorf("Restore returned %+v", restored)
+	}
+}
+
+func testHistory(t *testing.T, ctx context.Context, repo UserRepository) {
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	if _, err := repo.Update(ctx, u.ID, "", func(u *user) error { u.Name = "Alice Smith"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, u.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Restore(ctx, u.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := repo.History(ctx, u.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var actions []string
+	for _, e := range entries {
+		actions = append(actions, e.Action)
+	}
+	want := []string{auditCreate, auditUpdate, auditDelete, auditRestore}
+	if !slices.Equal(actions, want) {
+		t.Fatalf("actions = %v, want %v", actions, want)
+	}
+	if string(entries[0].Before) != "null" {
+		t.Errorf("create entry has before %s", entries[0].Before)
+	}
+	if string(entries[1].After) == string(entries[1].Before) {
+		t.Errorf("update entry has the same before and after: %s", entries[1].After)
+	}
+
+	_, err = repo.History(ctx, u.ID+100)
+	wantErr(t, "History of a missing user", err, errUserNotFound)
+}
+
+func testSearch(t *testing.T, ctx context.Context, repo UserRepository) {
+	mustCreate(t, ctx, repo, "Alice Smith", "alice@example.com")
+	mustCreate(t, ctx, repo, "Alicia Keys", "keys@music.test")
+	bob := mustCreate(t, ctx, repo, "Bob Smith", "bob@example.com")
+	if err := repo.Delete(ctx, bob.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"ali", []string{"Alice Smith", "Alicia Keys"}},
+		{"smith", []string{"Alice Smith"}},
+		{"example.com", []string{"Alice Smith"}},
+		{"ali keys", []string{"Alicia Keys"}},
+		{"nobody", nil},
+	}
+	for _, tt := range tests {
+		hits, total, err := repo.Search(ctx, searchTerms(tt.query), 10, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, h := range hits {
+			names = append(names, h.Name)
+		}
+		slices.Sort(names)
+		if !slices.Equal(names, tt.want) || total != int64(len(tt.want)) {
+			t.Errorf("Search(%q) = %v (total %d), want %v", tt.query, names, total, tt.want)
+		}
+	}
+}
+
+func testSearchHighlight(t *testing.T, ctx context.Context, repo UserRepository) {
+	mustCreate(t, ctx, repo, `Eve <img src=x onerror="alert(1)"> & Mallory`, "eve@example.com")
+
+	hits, _, err := repo.Search(ctx, searchTerms("eve img"), 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hits) != 1 {
+		t.Fatalf("Search found %d users, want 1", len(hits))
+	}
+
+	want := searchHighlight{
+		Name:  `<mark>Eve</mark> &lt;<mark>img</mark> src=x onerror=&#34;alert(1)&#34;&gt; &amp; Mallory`,
+		Email: `<mark>eve</mark>@example.com`,
+	}
+	if got := hits[0].Highlight; got != want {
+		t.Errorf("highlight = %+v, want %+v", got, want)
+	}
+}
+
+func testImport(t *testing.T, ctx context.Context, repo UserRepository) {
+	mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+
+	count := func() int64 {
+		t.Helper()
+		_, total, err := repo.List(ctx, listParams{limit: 1, sort: "id", column: "id"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return total
+	}
+
+	// A rolled back import leaves nothing behind.
+	err := repo.Import(ctx, func(insert func(user) error) (bool, error) {
+		if err := insert(user{Name: "Bob", Email: "bob@example.com"}); err != nil {
+			return false, err
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 1 {
+		t.Fatalf("rolled back import left %d users", n)
+	}
+
+	// So does one that fails.
+	importErr := errors.New("bad row")
+	err = repo.Import(ctx, func(insert func(user) error) (bool, error) {
+		insert(user{Name: "Bob", Email: "bob@example.com"})
+		return true, importErr
+	})
+	wantErr(t, "failing import", err, importErr)
+	if n := count(); n != 1 {
+		t.Fatalf("failed import left %d users", n)
+	}
+
+	// A duplicate fails on its own without undoing the other rows.
+	var dupErr error
+	err = repo.Import(ctx, func(insert func(user) error) (bool, error) {
+		if err := insert(user{Name: "Bob", Email: "bob@example.com"}); err != nil {
+			return false, err
+		}
+		dupErr = insert(user{Name: "Alice 2", Email: "ALICE@example.com"})
+		if err := insert(user{Name: "Carol", Email: "carol@example.com"}); err != nil {
+			return false, err
+		}
+		return true, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErr(t, "duplicate row", dupErr, errEmailTaken)
+	if n := count(); n != 3 {
+		t.Fatalf("import stored %d users, want 3", n)
+	}
+
+	if _, err := repo.GetByEmail(ctx, "carol@example.com"); err != nil {
+		t.Errorf("row after the duplicate was not stored: %v", err)
+	}
+}
+
+func testExport(t *testing.T, ctx context.Context, repo UserRepository) {
+	alice := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	mustCreate(t, ctx, repo, "Bob", "bob@example.com")
+	if err := repo.Delete(ctx, alice.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	export := func(includeDeleted bool) []string {
+		t.Helper()
+		var got []string
+		err := repo.Export(ctx, includeDeleted, func(u *user) error {
+			got = append(got, fmt.Sprintf("%s deleted=%t", u.Name, u.DeletedAt != nil))
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if got, want := export(false), []string{"Bob deleted=false"}; !slices.Equal(got, want) {
+		t.Errorf("Export = %v, want %v", got, want)
+	}
+	if got, want := export(true), []string{"Alice deleted=true", "Bob deleted=false"}; !slices.Equal(got, want) {
+		t.Errorf("Export with deleted = %v, want %v", got, want)
+	}
+}
+
+func testEvents(t *testing.T, ctx context.Context, repo UserRepository) {
+	last, err := repo.LastEventID(ctx)
+	if err != nil || last != 0 {
+		t.Fatalf("LastEventID of an empty repository = %d, %v", last, err)
+	}
+
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	if _, err := repo.Update(ctx, u.ID, "", func(u *user) error { u.Name = "Alice Smith"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// Failed writes record nothing.
+	repo.Create(ctx, user{Name: "Dup", Email: "alice@example.com"})
+	if err := repo.Delete(ctx, u.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	repo.Delete(ctx, u.ID, "")
+
+	events, err := repo.Events(ctx, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+	want := []string{eventUserCreated, eventUserUpdated, eventUserDeleted}
+	if !slices.Equal(types, want) {
+		t.Fatalf("event types = %v, want %v", types, want)
+	}
+
+	last, err = repo.LastEventID(ctx)
+	if err != nil || last != events[2].ID {
+		t.Errorf("LastEventID = %d, %v, want %d", last, err, events[2].ID)
+	}
+
+	after, err := repo.Events(ctx, events[0].ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 1 || after[0].ID != events[1].ID {
+		t.Errorf("Events after %d limit 1 = %+v", events[0].ID, after)
+	}
+	if rest, _ := repo.Events(ctx, last, 10); len(rest) != 0 {
+		t.Errorf("Events after the last one = %+v", rest)
+	}
+}
+
+func testSessions(t *testing.T, ctx context.Context, repo UserRepository) {
+	now := time.Now().UTC()
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+
+	if hash, err := repo.PasswordHash(ctx, u.ID); err != nil || hash != "" {
+		t.Fatalf("PasswordHash of a new user = %q, %v", hash, err)
+	}
+	if err := repo.SetPassword(ctx, u.ID, "hash-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := repo.LoginState(ctx, "Alice@Example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.UserID != u.ID || st.PasswordHash != "hash-1" || st.LockedUntil != nil {
+		t.Fatalf("LoginState = %+v", st)
+	}
+
+	// The third failure in a row locks the user.
+	lockUntil := now.Add(time.Minute)
+	for i := 0; i < 3; i++ {
+		if err := repo.RecordFailedLogin(ctx, u.ID, 3, lockUntil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st, _ = repo.LoginState(ctx, u.Email); st.LockedUntil == nil || !st.LockedUntil.Equal(lockUntil) {
+		t.Fatalf("user not locked after 3 failures: %+v", st)
+	}
+
+	// A session clears the lock.
+	if _, err := repo.CreateSession(ctx, u.ID, "session-1", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if st, _ = repo.LoginState(ctx, u.Email); st.LockedUntil != nil {
+		t.Errorf("session did not clear the lock: %+v", st)
+	}
+	if _, err := repo.CreateSession(ctx, u.ID, "session-2", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.CreateSession(ctx, u.ID, "session-expired", now.Add(-2*time.Hour), now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if id, err := repo.FindSession(ctx, "session-1", now); err != nil || id != u.ID {
+		t.Errorf("FindSession = %d, %v", id, err)
+	}
+	_, err = repo.FindSession(ctx, "session-expired", now)
+	wantErr(t, "FindSession of an expired session", err, errInvalidSession)
+	_, err = repo.FindSession(ctx, "unknown", now)
+	wantErr(t, "FindSession of an unknown session", err, errInvalidSession)
+
+	// Changing the password ends every other session.
+	if err := repo.ChangePassword(ctx, u.ID, "hash-2", "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.FindSession(ctx, "session-1", now)
+	wantErr(t, "FindSession after ChangePassword", err, errInvalidSession)
+	if _, err := repo.FindSession(ctx, "session-2", now); err != nil {
+		t.Errorf("ChangePassword ended the kept session: %v", err)
+	}
+	if hash, _ := repo.PasswordHash(ctx, u.ID); hash != "hash-2" {
+		t.Errorf("PasswordHash after ChangePassword = %q", hash)
+	}
+
+	if err := repo.DeleteSession(ctx, "session-2"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.FindSession(ctx, "session-2", now)
+	wantErr(t, "FindSession after DeleteSession", err, errInvalidSession)
+
+	// Sessions of deleted users stop working, and deleted users cannot log in.
+	if _, err := repo.CreateSession(ctx, u.ID, "session-3", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Delete(ctx, u.ID, ""); err != nil {
+		t.Fatal(err)
+	}
+	_, err = repo.FindSession(ctx, "session-3", now)
+	wantErr(t, "FindSession of a deleted user", err, errInvalidSession)
+	_, err = repo.LoginState(ctx, u.Email)
+	wantErr(t, "LoginState of a deleted user", err, errUserNotFound)
+	err = repo.SetPassword(ctx, u.ID, "hash-3")
+	wantErr(t, "SetPassword of a deleted user", err, errUserNotFound)
+}
+
+func testPasswordReset(t *testing.T, ctx context.Context, repo UserRepository) {
+	now := time.Now().UTC()
+	u := mustCreate(t, ctx, repo, "Alice", "alice@example.com")
+	if _, err := repo.CreateSession(ctx, u.ID, "session-1", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.CreatePasswordReset(ctx, u.ID, "reset-1", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	// A newer token replaces the earlier one.
+	if err := repo.CreatePasswordReset(ctx, u.ID, "reset-2", now, now.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	err := repo.ResetPassword(ctx, "reset-1", "hash-1", now)
+	wantErr(t, "ResetPassword with a replaced token", err, errInvalidResetToken)
+
+	_, err = repo.FindSession(ctx, "session-1", now)
+	if err != nil {
+		t.Fatalf("session ended before the reset: %v", err)
+	}
+
+	if err := repo.ResetPassword(ctx, "reset-2", "hash-2", now); err != nil {
+		t.Fatal(err)
+	}
+	if hash, _ := repo.PasswordHash(ctx, u.ID); hash != "hash-2" {
+		t.Errorf("PasswordHash after reset = %q", hash)
+	}
+	_, err = repo.FindSession(ctx, "session-1", now)
+	wantErr(t, "FindSession after a reset", err, errInvalidSession)
+
+	err = repo.ResetPassword(ctx, "reset-2", "hash-3", now)
+	wantErr(t, "ResetPassword with a used token", err, errInvalidResetToken)
+
+	if err := repo.CreatePasswordReset(ctx, u.ID, "reset-3", now, now.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	err = repo.ResetPassword(ctx, "reset-3", "hash-3", now.Add(2*time.Minute))
+	wantErr(t, "ResetPassword with an expired token", err, errInvalidResetToken)
+	err = repo.ResetPassword(ctx, "unknown", "hash-3", now)
+	wantErr(t, "ResetPassword with an unknown token", err, errInvalidResetToken)
+}
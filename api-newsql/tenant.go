@@ -0,0 +1,593 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// tenantIDPattern keeps tenant IDs usable both as a DNS label, for
+// subdomain routing, and as a file name.
+var tenantIDPattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?$`)
+
+var (
+	errTenantNotFound  = errors.New("tenant not found")
+	errTenantExists    = errors.New("tenant already exists")
+	errInvalidTenantID = errors.New("invalid tenant ID")
+)
+
+// tenant is one isolated users database together with everything bound to
+// it: the repository, the change feed, the backups and the write gate used
+// by restores. The default tenant, with an empty ID, is the -db database;
+// every other tenant has its own file in the tenants directory.
+//
+// Handlers reach the database only through the tenant of the request, so a
+// query can never read or write another tenant's data.
+type tenant struct {
+	id        string
+	db        *sql.DB
+	users     UserRepository
+	events    *eventBroker
+	backupDir string
+
+	// writes is held shared by every write request and exclusively by a
+	// restore, so that a restore never overlaps a write. deleted, guarded
+	// by writes, is set by deprovision once the final backup is taken.
+	writes  sync.RWMutex
+	deleted bool
+
+	// Guarded by tenantPool.mu. A tenant evicted while requests still use
+	// it is closed by the last release.
+	refs    int
+	elem    *list.Element
+	evicted bool
+	closed  chan struct{}
+}
+
+func newTenant(id string, db *sql.DB, backupDir string) *tenant {
+	events := newEventBroker()
+	return &tenant{
+		id:        id,
+		db:        db,
+		users:     newSQLiteUserRepository(db, events),
+		events:    events,
+		backupDir: backupDir,
+		closed:    make(chan struct{}),
+	}
+}
+
+func (t *tenant) close() {
+	t.events.close()
+	if err := t.db.Close(); err != nil {
+		log.Printf("closing tenant %s: %v", t.id, err)
+	}
+	close(t.closed)
+}
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, t *tenant) context.Context {
+	return context.WithValue(ctx, tenantKey{}, t)
+}
+
+// tenantFrom returns the tenant resolved for the request. Every request
+// passes through server.resolveTenant, so it is always set.
+func tenantFrom(ctx context.Context) *tenant {
+	return ctx.Value(tenantKey{}).(*tenant)
+}
+
+func usersFor(r *http.Request) UserRepository {
+	return tenantFrom(r.Context()).users
+}
+
+type tenantInfo struct {
+	ID        string `json:"id"`
+	SizeBytes int64  `json:"size_bytes"`
+	Open      bool   `json:"open"`
+
+	// AdminKey is the first API key of a new tenant, only set by provision
+	// and shown once.
+	AdminKey string `json:"admin_key,omitempty"`
+}
+
+// tenantPool opens tenant databases on first use and keeps at most maxOpen
+// of them open, closing the least recently used one beyond that. The files
+// in dir are the registry of tenants: a tenant exists once its file does.
+type tenantPool struct {
+	def       *tenant
+	dir       string
+	backupDir string
+	maxOpen   int
+
+	mu       sync.Mutex
+	open     map[string]*tenant
+	opening  map[string]*tenantOpening
+	lru      *list.List // of *tenant, most recently used first
+	deleting map[string]bool
+}
+
+// tenantOpening stands in for a tenant whose database is being opened and
+// migrated outside p.mu. Requests for the same tenant wait on done instead
+// of opening it a second time.
+type tenantOpening struct {
+	done chan struct{}
+	err  error
+}
+
+func newTenantPool(def *tenant, dir, backupDir string, maxOpen int) *tenantPool {
+	return &tenantPool{
+		def:       def,
+		dir:       dir,
+		backupDir: backupDir,
+		maxOpen:   max(maxOpen, 1),
+		open:      map[string]*tenant{},
+		opening:   map[string]*tenantOpening{},
+		lru:       list.New(),
+		deleting:  map[string]bool{},
+	}
+}
+
+func (p *tenantPool) path(id string) string {
+	return filepath.Join(p.dir, id+".db")
+}
+
+// acquire returns the tenant with the given ID, opening its database if
+// needed. The empty ID is the default tenant. Every acquire must be paired
+// with a release.
+func (p *tenantPool) acquire(id string) (*tenant, error) {
+	if id == "" {
+		return p.def, nil
+	}
+	if p.dir == "" || !tenantIDPattern.MatchString(id) {
+		return nil, errTenantNotFound
+	}
+
+	p.mu.Lock()
+	for {
+		if t, ok := p.open[id]; ok {
+			t.refs++
+			p.lru.MoveToFront(t.elem)
+			p.mu.Unlock()
+			return t, nil
+		}
+		if p.deleting[id] {
+			p.mu.Unlock()
+			return nil, errTenantNotFound
+		}
+
+		o, ok := p.opening[id]
+		if !ok {
+			break
+		}
+		p.mu.Unlock()
+		<-o.done
+		if o.err != nil {
+			return nil, o.err
+		}
+		p.mu.Lock()
+	}
+	o := &tenantOpening{done: make(chan struct{})}
+	p.opening[id] = o
+	p.mu.Unlock()
+
+	t, err := p.openExisting(id)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err == nil {
+		t.refs++
+	}
+	p.opened(o, id, t, err)
+	return t, err
+}
+
+func (p *tenantPool) release(t *tenant) {
+	if t == p.def {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t.refs--
+	if t.refs == 0 && t.evicted {
+		t.close()
+	}
+}
+
+func (p *tenantPool) openExisting(id string) (*tenant, error) {
+	if _, err := os.Stat(p.path(id)); errors.Is(err, fs.ErrNotExist) {
+		return nil, errTenantNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return p.openTenant(id)
+}
+
+func (p *tenantPool) openTenant(id string) (*tenant, error) {
+	db, err := openDB(p.path(id))
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateUp(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating tenant %s: %w", id, err)
+	}
+
+	return newTenant(id, db, filepath.Join(p.backupDir, "tenants", id)), nil
+}
+
+// opened ends the opening o of tenant id, adding t to the pool on success,
+// and wakes the requests waiting for it. The caller holds p.mu.
+func (p *tenantPool) opened(o *tenantOpening, id string, t *tenant, err error) {
+	delete(p.opening, id)
+	o.err = err
+	close(o.done)
+	if err == nil {
+		p.add(t)
+	}
+}
+
+// add puts a freshly opened tenant into the pool and evicts the least
+// recently used tenants beyond maxOpen. The caller holds p.mu.
+func (p *tenantPool) add(t *tenant) {
+	t.elem = p.lru.PushFront(t)
+	p.open[t.id] = t
+
+	for p.lru.Len() > p.maxOpen {
+		p.evict(p.lru.Back().Value.(*tenant))
+	}
+}
+
+// evict takes t out of the pool and closes it once no request uses it. The
+// caller holds p.mu.
+func (p *tenantPool) evict(t *tenant) {
+	p.lru.Remove(t.elem)
+	delete(p.open, t.id)
+	t.evicted = true
+	if t.refs == 0 {
+		t.close()
+	}
+}
+
+// provision creates the database of a new tenant, runs the migrations on it
+// and issues the tenant's first API key, with every scope but operator.
+func (p *tenantPool) provision(id string) (*tenantInfo, error) {
+	if !tenantIDPattern.MatchString(id) {
+		return nil, errInvalidTenantID
+	}
+
+	p.mu.Lock()
+	if _, ok := p.open[id]; ok || p.opening[id] != nil || p.deleting[id] {
+		p.mu.Unlock()
+		return nil, errTenantExists
+	}
+	if err := os.MkdirAll(p.dir, 0o755); err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	f, err := os.OpenFile(p.path(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if errors.Is(err, fs.ErrExist) {
+		p.mu.Unlock()
+		return nil, errTenantExists
+	} else if err != nil {
+		p.mu.Unlock()
+		return nil, err
+	}
+	f.Close()
+	o := &tenantOpening{done: make(chan struct{})}
+	p.opening[id] = o
+	p.mu.Unlock()
+
+	t, err := p.openTenant(id)
+	var k *apiKey
+	if err == nil {
+		if k, err = createAPIKey(t.db, "admin", []string{scopeAdmin, scopeUsersRead, scopeUsersWrite}); err != nil {
+			t.close()
+		}
+	}
+	if err != nil {
+		if rmErr := p.removeFiles(id); rmErr != nil {
+			log.Printf("removing tenant %s: %v", id, rmErr)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.opened(o, id, t, err)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := p.info(id)
+	if err != nil {
+		return nil, err
+	}
+	info.AdminKey = k.Key
+	return info, nil
+}
+
+// deprovision backs up a tenant's database and deletes it. The tenant stops
+// resolving right away; in-flight writes finish before the backup is taken,
+// later ones are refused, and open change feeds are closed. The files are
+// removed once the last request using the tenant has returned. deprovision
+// waits for that until ctx ends; the removal goes ahead either way.
+func (p *tenantPool) deprovision(ctx context.Context, id string) (*backup, error) {
+	if p.dir == "" || !tenantIDPattern.MatchString(id) {
+		return nil, errTenantNotFound
+	}
+
+	// The reference taken by acquire keeps the tenant open once evicted.
+	t, err := p.acquire(id)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	if p.deleting[id] {
+		p.mu.Unlock()
+		p.release(t)
+		return nil, errTenantNotFound
+	}
+	if !t.evicted {
+		p.evict(t)
+	}
+	p.deleting[id] = true
+	p.mu.Unlock()
+
+	// Nothing may be written once the final backup is taken: it would be
+	// acknowledged and then deleted with the database.
+	t.writes.Lock()
+	final, err := createBackup(t.db, t.backupDir, "deprovision")
+	if err == nil {
+		t.deleted = true
+	}
+	t.writes.Unlock()
+	if err != nil {
+		p.mu.Lock()
+		delete(p.deleting, id)
+		p.mu.Unlock()
+		p.release(t)
+		return nil, fmt.Errorf("backing up tenant %s: %w", id, err)
+	}
+	t.events.close()
+
+	removed := make(chan error, 1)
+	go func() {
+		<-t.closed
+		err := p.removeFiles(id)
+		if err != nil {
+			log.Printf("removing tenant %s: %v", id, err)
+		}
+
+		p.mu.Lock()
+		delete(p.deleting, id)
+		p.mu.Unlock()
+		removed <- err
+	}()
+	p.release(t)
+
+	select {
+	case err := <-removed:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+	}
+	return final, nil
+}
+
+// removeFiles deletes the database of a tenant along with its WAL and
+// shared memory files, which a later tenant with the same ID must not
+// pick up.
+func (p *tenantPool) removeFiles(id string) error {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if err := os.Remove(p.path(id) + suffix); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *tenantPool) info(id string) (*tenantInfo, error) {
+	fi, err := os.Stat(p.path(id))
+	if err != nil {
+		return nil, err
+	}
+	_, open := p.open[id]
+	return &tenantInfo{ID: id, SizeBytes: fi.Size(), Open: open}, nil
+}
+
+func (p *tenantPool) list() ([]*tenantInfo, error) {
+	if p.dir == "" {
+		return []*tenantInfo{}, nil
+	}
+
+	entries, err := os.ReadDir(p.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return []*tenantInfo{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	tenants := []*tenantInfo{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".db")
+		if !ok || e.IsDir() || !tenantIDPattern.MatchString(id) || p.deleting[id] {
+			continue
+		}
+		info, err := p.info(id)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, info)
+	}
+
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].ID < tenants[j].ID })
+	return tenants, nil
+}
+
+// closeStreams ends the change feeds of every open tenant, for shutdown.
+func (p *tenantPool) closeStreams() {
+	p.def.events.close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.open {
+		t.events.close()
+	}
+}
+
+// close closes every open tenant database. The default tenant is left to
+// the caller, which opened it.
+func (p *tenantPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, t := range p.open {
+		p.evict(t)
+	}
+}
+
+// requestTenantID finds the tenant a request is for: the X-Tenant-ID header
+// or, when tenantDomain is set, the subdomain of the host under it. Both
+// may be given as long as they agree. An empty ID means the default tenant.
+func requestTenantID(r *http.Request, tenantDomain string) (string, error) {
+	header := strings.TrimSpace(r.Header.Get("X-Tenant-ID"))
+
+	var sub string
+	if tenantDomain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		sub, _ = strings.CutSuffix(strings.ToLower(host), "."+strings.ToLower(tenantDomain))
+		if sub == strings.ToLower(host) {
+			sub = ""
+		}
+	}
+
+	id := header
+	switch {
+	case header != "" && sub != "" && header != sub:
+		return "", errors.New("X-Tenant-ID does not match the tenant of the host name")
+	case header == "":
+		id = sub
+	}
+	if id != "" && !tenantIDPattern.MatchString(id) {
+		return "", errInvalidTenantID
+	}
+	return id, nil
+}
+
+// resolveTenant attaches the tenant of the request to its context and keeps
+// the tenant's database open until the request is done.
+func (s *server) resolveTenant(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Responses differ per tenant, so caches must not share them.
+		w.Header().Add("Vary", "X-Tenant-ID")
+
+		id, err := requestTenantID(r, s.tenantDomain)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		t, err := s.tenants.acquire(id)
+		if errors.Is(err, errTenantNotFound) {
+			writeProblem(w, r, http.StatusNotFound, fmt.Sprintf("Tenant %q not found", id))
+			return
+		} else if err != nil {
+			writeServerError(w, r, err)
+			return
+		}
+		defer s.tenants.release(t)
+
+		next.ServeHTTP(w, r.WithContext(withTenant(r.Context(), t)))
+	})
+}
+
+// requireOperator lets through only requests to the default tenant made
+// with its credentials, which manage the whole server. requireScope must run
+// first, checking for the operator scope.
+func requireOperator(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p, ok := principalFrom(r.Context())
+		if !ok || p.Tenant != "" || tenantFrom(r.Context()).id != "" {
+			writeProblem(w, r, http.StatusForbidden, "Tenants can only be managed through the default tenant, with its credentials.")
+			return
+		}
+		next(w, r)
+	}
+}
+
+type tenantRequest struct {
+	ID string `json:"id"`
+}
+
+func (s *server) listTenantsHandler(w http.ResponseWriter, r *http.Request) {
+	tenants, err := s.tenants.list()
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"data": tenants})
+}
+
+func (s *server) provisionTenantHandler(w http.ResponseWriter, r *http.Request) {
+	if s.tenants.dir == "" {
+		writeProblem(w, r, http.StatusConflict, "Multi-tenancy is disabled; start the server with -tenants-dir.")
+		return
+	}
+
+	var req tenantRequest
+	if err := decodeJSON(w, r, &req); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	info, err := s.tenants.provision(req.ID)
+	if errors.Is(err, errInvalidTenantID) {
+		writeValidationProblem(w, r, []fieldError{{Field: "id", Message: "must be a lowercase DNS label of letters, digits and hyphens"}})
+		return
+	} else if errors.Is(err, errTenantExists) {
+		writeProblem(w, r, http.StatusConflict, "A tenant with this ID already exists.")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Location", "/admin/tenants/"+info.ID)
+	writeJSON(w, http.StatusCreated, info)
+}
+
+func (s *server) deprovisionTenantHandler(w http.ResponseWriter, r *http.Request) {
+	final, err := s.tenants.deprovision(r.Context(), r.PathValue("id"))
+	if errors.Is(err, errTenantNotFound) {
+		writeProblem(w, r, http.StatusNotFound, "Tenant not found")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]any{"deleted": r.PathValue("id"), "backup": final})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestTenantPool(t *testing.T) *tenantPool {
+	t.Helper()
+
+	dir := t.TempDir()
+	backupDir := filepath.Join(dir, "backups")
+	p := newTenantPool(newTenant("", newTestDB(t), backupDir), filepath.Join(dir, "tenants"), backupDir, 4)
+	t.Cleanup(p.close)
+	return p
+}
+
+// tenantFilesExist reports whether any file of the tenant's database is
+// left in the tenants directory.
+func tenantFilesExist(t *testing.T, p *tenantPool, id string) bool {
+	t.Helper()
+
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		if _, err := os.Stat(p.path(id) + suffix); err == nil {
+			return true
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			t.Fatal(err)
+		}
+	}
+	return false
+}
+
+func TestDeprovision(t *testing.T) {
+	p := newTestTenantPool(t)
+	if _, err := p.provision("acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	final, err := p.deprovision(context.Background(), "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(p.backupDir, "tenants", "acme", final.Name)); err != nil {
+		t.Errorf("final backup: %v", err)
+	}
+	if tenantFilesExist(t, p, "acme") {
+		t.Error("tenant files left after deprovision")
+	}
+	if _, err := p.acquire("acme"); !errors.Is(err, errTenantNotFound) {
+		t.Errorf("acquire after deprovision: got %v, want %v", err, errTenantNotFound)
+	}
+}
+
+// A request that resolved the tenant before the deprovision can no longer
+// write once the final backup is taken, and the files are removed when it
+// returns even though the admin request gave up waiting.
+func TestDeprovisionWhileInUse(t *testing.T) {
+	p := newTestTenantPool(t)
+	if _, err := p.provision("acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	inUse, err := p.acquire("acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.deprovision(ctx, "acme"); err != nil {
+		t.Fatal(err)
+	}
+
+	write := (&server{}).quiesce(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := usersFor(r).Create(r.Context(), user{Name: "Alice", Email: "alice@example.com"}); err != nil {
+			t.Error(err)
+		}
+		w.WriteHeader(http.StatusCreated)
+	})
+	req := httptest.NewRequest(http.MethodPost, "/users", nil)
+	rec := httptest.NewRecorder()
+	write(rec, req.WithContext(withTenant(req.Context(), inUse)))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("write during deprovision: status %d, want 404", rec.Code)
+	}
+
+	if !tenantFilesExist(t, p, "acme") {
+		t.Fatal("tenant files removed while a request still uses the tenant")
+	}
+
+	p.release(inUse)
+	for deadline := time.Now().Add(5 * time.Second); tenantFilesExist(t, p, "acme"); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("tenant files left after the last request returned")
+		}
+	}
+}
+
+// Credentials and data of a tenant are invisible from every other tenant:
+// API keys, sessions and JWTs only authenticate on their own tenant, and a
+// user created in one tenant is neither listed nor found in another.
+func TestTenantIsolation(t *testing.T) {
+	p := newTestTenantPool(t)
+	secret := []byte("shared secret")
+	s := &server{db: p.def.db, tenants: p, tenantDomain: "example.com", jwt: &jwtVerifier{hmacSecret: secret}}
+	h := s.resolveTenant(s.routes())
+
+	keys := map[string]string{}
+	for _, id := range []string{"acme", "globex"} {
+		info, err := p.provision(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[id] = info.AdminKey
+	}
+
+	serve := func(method, target, host string, header http.Header, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Host = host
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	tenantHeader := func(id string, creds http.Header) http.Header {
+		header := http.Header{"X-Tenant-Id": {id}}
+		for k, v := range creds {
+			header[k] = v
+		}
+		return header
+	}
+
+	// Alice lives in acme and has a password, so she can log in there.
+	rec := serve(http.MethodPost, "/users", "localhost", tenantHeader("acme", apiKeyHeader(keys["acme"])), `{"name": "Alice", "email": "alice@example.com"}`)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create in acme: status %d: %s", rec.Code, rec.Body)
+	}
+	var alice user
+	if err := json.Unmarshal(rec.Body.Bytes(), &alice); err != nil {
+		t.Fatal(err)
+	}
+	target := fmt.Sprintf("/users/%d", alice.ID)
+	if rec := serve(http.MethodPut, target+"/password", "localhost", tenantHeader("acme", apiKeyHeader(keys["acme"])), `{"password": "correct horse battery"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("set password: status %d: %s", rec.Code, rec.Body)
+	}
+	rec = serve(http.MethodPost, "/auth/login", "acme.example.com", nil, `{"email": "alice@example.com", "password": "correct horse battery"}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+	var login loginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &login); err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(tenant string) string {
+		claims := map[string]any{"sub": "bob", "scope": scopeUsersRead, "exp": time.Now().Add(time.Hour).Unix()}
+		if tenant != "" {
+			claims["tenant"] = tenant
+		}
+		return signJWT(t, "HS256", secret, claims)
+	}
+
+	tests := []struct {
+		name   string
+		host   string
+		header http.Header
+		status int
+	}{
+		{"acme key on acme", "localhost", tenantHeader("acme", apiKeyHeader(keys["acme"])), http.StatusOK},
+		{"acme key on globex", "localhost", tenantHeader("globex", apiKeyHeader(keys["acme"])), http.StatusUnauthorized},
+		{"acme key on the default tenant", "localhost", apiKeyHeader(keys["acme"]), http.StatusUnauthorized},
+		{"acme session on acme", "acme.example.com", bearerHeader(login.Token), http.StatusOK},
+		{"acme session on globex", "globex.example.com", bearerHeader(login.Token), http.StatusUnauthorized},
+		{"acme JWT on acme", "acme.example.com", bearerHeader(token("acme")), http.StatusOK},
+		{"acme JWT on globex", "globex.example.com", bearerHeader(token("acme")), http.StatusUnauthorized},
+		{"acme JWT on the default tenant", "localhost", bearerHeader(token("acme")), http.StatusUnauthorized},
+		{"default JWT on acme", "acme.example.com", bearerHeader(token("")), http.StatusUnauthorized},
+		{"header and subdomain agree", "acme.example.com", tenantHeader("acme", apiKeyHeader(keys["acme"])), http.StatusOK},
+		{"header and subdomain differ", "acme.example.com", tenantHeader("globex", apiKeyHeader(keys["globex"])), http.StatusBadRequest},
+		{"unknown tenant", "initech.example.com", apiKeyHeader(keys["acme"]), http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := serve(http.MethodGet, "/users", tt.host, tt.header, ""); rec.Code != tt.status {
+				t.Errorf("status %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+
+	t.Run("data", func(t *testing.T) {
+		globex := tenantHeader("globex", apiKeyHeader(keys["globex"]))
+		rec := serve(http.MethodGet, "/users", "localhost", globex, "")
+		var page struct {
+			Data []user `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != http.StatusOK || len(page.Data) != 0 {
+			t.Errorf("list on globex: status %d, %d users, want none", rec.Code, len(page.Data))
+		}
+		if rec := serve(http.MethodGet, target, "localhost", globex, ""); rec.Code != http.StatusNotFound {
+			t.Errorf("get Alice on globex: status %d, want 404", rec.Code)
+		}
+		if rec := serve(http.MethodGet, "/users/search?q=alice", "localhost", globex, ""); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "alice@example.com") {
+			t.Errorf("search on globex: status %d: %s", rec.Code, rec.Body)
+		}
+		if rec := serve(http.MethodGet, target, "localhost", tenantHeader("acme", apiKeyHeader(keys["acme"])), ""); rec.Code != http.StatusOK {
+			t.Errorf("get Alice on acme: status %d, want 200", rec.Code)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/mail"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength  = 100
+	maxEmailLength = 254
+)
+
+func (u *user) normalize() {
+	u.Name = strings.TrimSpace(u.Name)
+	u.Email = strings.TrimSpace(u.Email)
+}
+
+func (u user) validate() []fieldError {
+	var errs []fieldError
+	errs = appendIf(errs, "name", validateName(u.Name))
+	errs = appendIf(errs, "email", validateEmail(u.Email))
+	return errs
+}
+
+func validateName(name string) string {
+	switch {
+	case name == "":
+		return "is required"
+	case utf8.RuneCountInString(name) > maxNameLength:
+		return fmt.Sprintf("must be at most %d characters", maxNameLength)
+	}
+	return ""
+}
+
+func validateEmail(email string) string {
+	switch {
+	case email == "":
+		return "is required"
+	case len(email) > maxEmailLength:
+		return fmt.Sprintf("must be at most %d characters", maxEmailLength)
+	}
+
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email || !strings.Contains(email[strings.LastIndex(email, "@"):], ".") {
+		return "must be a valid email address"
+	}
+	return ""
+}
+
+func appendIf(errs []fieldError, field, message string) []fieldError {
+	if message == "" {
+		return errs
+	}
+	return append(errs, fieldError{Field: field, Message: message})
+}
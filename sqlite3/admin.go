@@ -0,0 +1,458 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Limites das consultas feitas por POST /admin/query
+const (
+	defaultQueryRows = 100
+	maxQueryRows     = 1000
+	queryTimeout     = 2 * time.Second
+)
+
+// Coluna de uma tabela, como em pragma_table_info
+type ColumnInfo struct {
+	Name       string  `json:"name"`
+	Type       string  `json:"type"`
+	NotNull    bool    `json:"not_null"`
+	Default    *string `json:"default"`
+	PrimaryKey int     `json:"primary_key"` // posição na chave primária, 0 se não faz parte
+}
+
+// Índice de uma tabela, como em pragma_index_list e pragma_index_info
+type IndexInfo struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Origin  string   `json:"origin"` // "c" (CREATE INDEX), "u" (UNIQUE) ou "pk"
+	Columns []string `json:"columns"`
+}
+
+// Descrição de uma tabela devolvida por GET /admin/tables
+type TableInfo struct {
+	Name    string       `json:"name"`
+	SQL     string       `json:"sql"`
+	Rows    int64        `json:"rows"`
+	Columns []ColumnInfo `json:"columns"`
+	Indexes []IndexInfo  `json:"indexes"`
+}
+
+// Corpo de POST /admin/query
+type QueryRequest struct {
+	SQL   string `json:"sql"`
+	Limit int    `json:"limit"`
+}
+
+// Resultado de POST /admin/query; Truncated indica que havia mais linhas
+// além do limite
+type QueryResult struct {
+	Columns   []string `json:"columns"`
+	Rows      [][]any  `json:"rows"`
+	Truncated bool     `json:"truncated"`
+}
+
+// Exige o header "Authorization: Bearer <token>" com o token de admin. Sem
+// token configurado as rotas de admin ficam desligadas.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			writeError(w, http.StatusNotFound, "rota não encontrada")
+			return
+		}
+
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "token de admin inválido")
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Coloca um identificador entre aspas para usá-lo em SQL
+func quoteIdent(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// Manipulador que lista as tabelas com colunas, índices e número de linhas
+func handleAdminTables(w http.ResponseWriter, r *http.Request) {
+	tables, err := describeTables(r.Context())
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, tables)
+}
+
+func describeTables(ctx context.Context) ([]TableInfo, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, sql FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	tables := []TableInfo{}
+	for rows.Next() {
+		var t TableInfo
+		if err := rows.Scan(&t.Name, &t.SQL); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tables = append(tables, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// As consultas de cada tabela só rodam depois de fechar a listagem, já
+	// que em memória o pool tem uma única conexão
+	for i := range tables {
+		t := &tables[i]
+		if err := db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+quoteIdent(t.Name)).Scan(&t.Rows); err != nil {
+			return nil, err
+		}
+		if t.Columns, err = describeColumns(ctx, t.Name); err != nil {
+			return nil, err
+		}
+		if t.Indexes, err = describeIndexes(ctx, t.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	return tables, nil
+}
+
+func describeColumns(ctx context.Context, table string) ([]ColumnInfo, error) {
+	rows, err := db.QueryContext(ctx, `SELECT name, type, "notnull", dflt_value, pk FROM pragma_table_info(?) ORDER BY cid`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := []ColumnInfo{}
+	for rows.Next() {
+		var c ColumnInfo
+		var def sql.NullString
+		if err := rows.Scan(&c.Name, &c.Type, &c.NotNull, &def, &c.PrimaryKey); err != nil {
+			return nil, err
+		}
+		if def.Valid {
+			c.Default = &def.String
+		}
+		columns = append(columns, c)
+	}
+	return columns, rows.Err()
+}
+
+func describeIndexes(ctx context.Context, table string) ([]IndexInfo, error) {
+	rows, err := db.QueryContext(ctx, "SELECT name, \"unique\", origin FROM pragma_index_list(?) ORDER BY name", table)
+	if err != nil {
+		return nil, err
+	}
+	indexes := []IndexInfo{}
+	for rows.Next() {
+		var idx IndexInfo
+		if err := rows.Scan(&idx.Name, &idx.Unique, &idx.Origin); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		indexes = append(indexes, idx)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range indexes {
+		cols, err := db.QueryContext(ctx, "SELECT name FROM pragma_index_info(?) ORDER BY seqno", indexes[i].Name)
+		if err != nil {
+			return nil, err
+		}
+		indexes[i].Columns = []string{}
+		for cols.Next() {
+			var name sql.NullString // nulo para colunas calculadas
+			if err := cols.Scan(&name); err != nil {
+				cols.Close()
+				return nil, err
+			}
+			indexes[i].Columns = append(indexes[i].Columns, name.String)
+		}
+		cols.Close()
+		if err := cols.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return indexes, nil
+}
+
+// Tabelas que POST /admin/query pode ler; qualquer outra, inclusive o
+// sqlite_master e as tabelas virtuais, é recusada
+var queryableTables = []string{"users"}
+
+// Confere que o texto é uma única instrução começando com SELECT ou WITH.
+// Quais tabelas ela lê é conferido pelo próprio SQLite em runReadOnlyQuery.
+func checkReadOnlySQL(query string) error {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return errors.New("sql é obrigatório")
+	}
+	if countStatements(query) != 1 {
+		return errors.New("apenas uma instrução por consulta")
+	}
+
+	keyword := query
+	if end := strings.IndexFunc(query, func(r rune) bool { return !unicode.IsLetter(r) }); end >= 0 {
+		keyword = query[:end]
+	}
+	if keyword = strings.ToUpper(keyword); keyword != "SELECT" && keyword != "WITH" {
+		return errors.New("apenas consultas SELECT são permitidas")
+	}
+	return nil
+}
+
+// Conta as instruções do texto com as regras do tokenizador do SQLite, as
+// mesmas de sqlite3_complete: um ";" só separa instruções fora de strings,
+// identificadores entre aspas e comentários, e instruções vazias não
+// contam. Nenhum dos dois drivers expõe o resto ("tail") do
+// sqlite3_prepare, e o modernc.org/sqlite executa todas as instruções de um
+// texto, então a contagem precisa ser feita antes de o texto chegar ao
+// driver.
+func countStatements(query string) int {
+	n := 0
+	pending := false
+	for i := 0; i < len(query); {
+		switch c := query[i]; {
+		case c == ';':
+			if pending {
+				n++
+				pending = false
+			}
+			i++
+		case c == ' ' || c == '\t' || c == '\n' || c == '\f' || c == '\r':
+			i++
+		case strings.HasPrefix(query[i:], "--"):
+			if end := strings.IndexByte(query[i:], '\n'); end >= 0 {
+				i += end + 1
+			} else {
+				i = len(query)
+			}
+		case strings.HasPrefix(query[i:], "/*"):
+			if end := strings.Index(query[i+2:], "*/"); end >= 0 {
+				i += end + 4
+			} else {
+				i = len(query)
+			}
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			pending = true
+			i = skipQuoted(query, i)
+		default:
+			pending = true
+			i++
+		}
+	}
+	if pending {
+		n++
+	}
+	return n
+}
+
+// Devolve a posição logo após a string ou o identificador entre aspas que
+// começa em i. Aspas dobradas escapam a própria aspa, menos em [...].
+func skipQuoted(query string, i int) int {
+	closing := query[i]
+	if closing == '[' {
+		closing = ']'
+	}
+	for j := i + 1; j < len(query); j++ {
+		if query[j] != closing {
+			continue
+		}
+		if closing != ']' && j+1 < len(query) && query[j+1] == closing {
+			j++
+			continue
+		}
+		return j + 1
+	}
+	return len(query)
+}
+
+// Confere pelo plano da consulta (EXPLAIN) que ela só abre tabelas de
+// queryableTables, ou índices delas, no banco principal
+func checkQueryTables(ctx context.Context, conn *sql.Conn, query string) error {
+	allowed := map[int64]bool{}
+	rows, err := conn.QueryContext(ctx, "SELECT rootpage, tbl_name FROM sqlite_master WHERE rootpage > 0")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var page int64
+		var table string
+		if err := rows.Scan(&page, &table); err != nil {
+			rows.Close()
+			return err
+		}
+		allowed[page] = slices.Contains(queryableTables, table)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	plan, err := conn.QueryContext(ctx, "EXPLAIN "+query)
+	if err != nil {
+		return err
+	}
+	defer plan.Close()
+
+	for plan.Next() {
+		var addr, p1, p2, p3, p5 int64
+		var opcode string
+		var p4, comment any
+		if err := plan.Scan(&addr, &opcode, &p1, &p2, &p3, &p4, &p5, &comment); err != nil {
+			return err
+		}
+
+		switch opcode {
+		case "OpenRead", "ReopenIdx":
+			if p3 == 0 && allowed[p2] {
+				continue
+			}
+		case "OpenWrite", "VOpen":
+		default:
+			continue
+		}
+		return fmt.Errorf("apenas as tabelas %s podem ser consultadas", strings.Join(queryableTables, ", "))
+	}
+	return plan.Err()
+}
+
+// Manipulador que executa uma consulta somente leitura sobre as tabelas de
+// queryableTables. Além das checagens da consulta, ela roda no pool
+// somente leitura (queryDB), ou em memória em uma conexão com PRAGMA
+// query_only ligado, então o próprio SQLite recusa qualquer escrita, e é
+// cancelada após queryTimeout.
+func handleAdminQuery(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "JSON inválido: "+err.Error())
+		return
+	}
+	if err := checkReadOnlySQL(req.SQL); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Limit == 0 {
+		req.Limit = defaultQueryRows
+	}
+	if req.Limit < 1 || req.Limit > maxQueryRows {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("limit deve estar entre 1 e %d", maxQueryRows))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), queryTimeout)
+	defer cancel()
+
+	result, err := runReadOnlyQuery(ctx, req.SQL, req.Limit)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		// O driver pode relatar o cancelamento como "interrupted" em vez
+		// do erro do contexto
+		writeError(w, http.StatusGatewayTimeout, fmt.Sprintf("a consulta passou de %s", queryTimeout))
+	case err != nil:
+		// O erro vem do SQLite e descreve a consulta, não o servidor
+		writeError(w, http.StatusBadRequest, "consulta inválida: "+err.Error())
+	default:
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+func runReadOnlyQuery(ctx context.Context, query string, limit int) (*QueryResult, error) {
+	// Nada chega ao driver, nem o EXPLAIN, sem passar por essa checagem
+	if err := checkReadOnlySQL(query); err != nil {
+		return nil, err
+	}
+
+	pool := queryDB
+	if pool == nil {
+		pool = db
+	}
+	conn, err := pool.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return nil, err
+	}
+	defer func() {
+		// A conexão volta para o pool, então precisa voltar a aceitar escritas
+		if _, err := conn.ExecContext(context.Background(), "PRAGMA query_only = OFF"); err != nil {
+			log.Printf("desligando query_only: %v", err)
+			conn.Raw(func(any) error { return driver.ErrBadConn }) // descarta a conexão
+		}
+	}()
+
+	unrestrict, err := restrictQueryConn(conn)
+	defer unrestrict()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkQueryTables(ctx, conn, query); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	result := &QueryResult{Columns: columns, Rows: [][]any{}}
+	for rows.Next() {
+		if len(result.Rows) == limit {
+			result.Truncated = true
+			break
+		}
+
+		values := make([]any, len(columns))
+		ptrs := make([]any, len(columns))
+		for i := range values {
+			ptrs[i] = &values[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			if b, ok := v.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+		result.Rows = append(result.Rows, values)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCheckReadOnlySQL(t *testing.T) {
+	tests := []struct {
+		query string
+		ok    bool
+	}{
+		{"SELECT * FROM users", true},
+		{"  select 1;  ", true},
+		{"WITH n AS (SELECT 1) SELECT * FROM n", true},
+		{"", false},
+		{";", false},
+		{"DELETE FROM users", false},
+		{"PRAGMA query_only = OFF", false},
+		{"SELECTX 1", false},
+	}
+
+	for _, tt := range tests {
+		if err := checkReadOnlySQL(tt.query); (err == nil) != tt.ok {
+			t.Errorf("checkReadOnlySQL(%q) = %v", tt.query, err)
+		}
+	}
+}
+
+func TestRunReadOnlyQuery(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	for _, name := range []string{"Ana", "Bruno", "Carla"} {
+		if _, err := db.Exec("INSERT INTO users (name, email) VALUES (?, ?)", name, name+"@example.com"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := runReadOnlyQuery(ctx, "SELECT id, name FROM users ORDER BY id", 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Columns, []string{"id", "name"}) || len(result.Rows) != 3 || result.Truncated {
+		t.Fatalf("resultado = %+v", result)
+	}
+	// Textos voltam como string, não como []byte
+	if name, ok := result.Rows[0][1].(string); !ok || name != "Ana" {
+		t.Errorf("primeira linha = %#v", result.Rows[0])
+	}
+
+	result, err = runReadOnlyQuery(ctx, "SELECT name FROM users ORDER BY id", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Rows) != 2 || !result.Truncated {
+		t.Errorf("com limite 2: %d linhas, truncated = %t", len(result.Rows), result.Truncated)
+	}
+}
+
+func TestCountStatements(t *testing.T) {
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"SELECT 1", 1},
+		{"SELECT 1;", 1},
+		{" ; SELECT 1 ;; ", 1},
+		{"-- só um comentário", 0},
+		{"SELECT 1; SELECT 2", 2},
+		{"SELECT ';' FROM users", 1},
+		{"SELECT 'a'';' ; SELECT 2", 2},
+		{`SELECT "a;b", [c;d], ` + "`e;f`" + ` FROM users`, 1},
+		{"SELECT 1 -- ; DELETE FROM users", 1},
+		{"SELECT 1 /* ; */ ; DELETE FROM users", 2},
+		{"SELECT 1) ; PRAGMA query_only=OFF; DELETE FROM users; SELECT (1", 4},
+		{"SELECT 'sem fim; DELETE FROM users", 1},
+	}
+
+	for _, tt := range tests {
+		if got := countStatements(tt.query); got != tt.want {
+			t.Errorf("countStatements(%q) = %d, esperava %d", tt.query, got, tt.want)
+		}
+	}
+}
+
+// Só uma instrução, e só sobre as tabelas liberadas, chega a rodar: um ";"
+// dentro de uma string não atrapalha, e nem fechar o parêntese de uma
+// subconsulta nem um comentário escondem uma segunda instrução
+func TestRunReadOnlyQueryStatements(t *testing.T) {
+	t.Run("memória", func(t *testing.T) {
+		setupTestDB(t)
+		testRunReadOnlyQueryStatements(t)
+	})
+	t.Run("arquivo", func(t *testing.T) {
+		setupFileTestDB(t)
+		testRunReadOnlyQueryStatements(t)
+	})
+}
+
+func testRunReadOnlyQueryStatements(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	if _, err := db.Exec("INSERT INTO users (name, email) VALUES ('a;b', 'ab@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("CREATE TABLE secrets (value TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		query string
+		rows  int
+		ok    bool
+	}{
+		{"SELECT * FROM users WHERE name = 'a;b'", 1, true},
+		{"SELECT name FROM users;", 1, true},
+		{"SELECT name FROM users -- comentário", 1, true},
+		{"SELECT count(*) FROM users WHERE email = 'x'", 1, true},
+		{"WITH n AS (SELECT name FROM users) SELECT * FROM n", 1, true},
+		{"SELECT 1; DELETE FROM users", 0, false},
+		{"SELECT 1; SELECT 2", 0, false},
+		{"SELECT 1) ; PRAGMA query_only=OFF; DELETE FROM users; SELECT (1", 0, false},
+		{"SELECT 1) ; ATTACH '" + filepath.Join(dir, "evil.db") + "' AS evil; SELECT (1", 0, false},
+		{"SELECT 'a'';' FROM users; DELETE FROM users", 0, false},
+		{"SELECT 1 /* ; */; DELETE FROM users", 0, false},
+		{"SELECT * FROM secrets", 0, false},
+		{"SELECT name FROM users UNION SELECT value FROM secrets", 0, false},
+		{"SELECT * FROM sqlite_master", 0, false},
+		{"SELECT * FROM pragma_table_info('users')", 0, false},
+	}
+
+	for _, tt := range tests {
+		result, err := runReadOnlyQuery(ctx, tt.query, 10)
+		if (err == nil) != tt.ok {
+			t.Errorf("runReadOnlyQuery(%q) = %v", tt.query, err)
+			continue
+		}
+		if err == nil && len(result.Rows) != tt.rows {
+			t.Errorf("runReadOnlyQuery(%q): %d linhas, esperava %d", tt.query, len(result.Rows), tt.rows)
+		}
+	}
+	if n := countUsers(t); n != 1 {
+		t.Fatalf("%d usuários depois das consultas, esperava 1", n)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "evil.db")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("o ATTACH criou o arquivo: %v", err)
+	}
+}
+
+// O próprio SQLite recusa escritas, mesmo as que passariam pela checagem do
+// texto, e a conexão volta a aceitar escritas depois
+func TestRunReadOnlyQueryRejectsWrites(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+	if _, err := db.Exec("INSERT INTO users (name, email) VALUES ('Ana', 'ana@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, query := range []string{
+		"DELETE FROM users",
+		"WITH n AS (SELECT 1) DELETE FROM users",
+	} {
+		if _, err := runReadOnlyQuery(ctx, query, 10); err == nil {
+			t.Errorf("runReadOnlyQuery(%q) não falhou", query)
+		}
+	}
+	if n := countUsers(t); n != 1 {
+		t.Fatalf("%d usuários depois das escritas recusadas, esperava 1", n)
+	}
+
+	// Em memória o pool tem uma única conexão, a mesma usada pela consulta
+	if _, err := db.Exec("INSERT INTO users (name, email) VALUES ('Bruno', 'bruno@example.com')"); err != nil {
+		t.Fatalf("a conexão continuou somente leitura: %v", err)
+	}
+}
+
+func TestRunReadOnlyQueryTimeout(t *testing.T) {
+	setupTestDB(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := runReadOnlyQuery(ctx, "WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n) SELECT max(i) FROM n", 10)
+	if err == nil {
+		t.Fatal("a consulta sem fim terminou sem erro")
+	}
+	if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		t.Errorf("erro %v antes do prazo", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("a consulta levou %s para ser cancelada", elapsed)
+	}
+
+	// A conexão cancelada não impede as próximas consultas
+	if n := countUsers(t); n != 0 {
+		t.Errorf("COUNT(*) = %d", n)
+	}
+}
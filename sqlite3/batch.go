@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+)
+
+// Limite de usuários por requisição de lote, e de bytes do corpo, que é
+// conferido durante a leitura para que um corpo enorme não chegue a ser
+// carregado em memória
+const (
+	maxBatchSize  = 1000
+	maxBatchBytes = 1 << 20
+)
+
+// Modos do lote: "atomic" grava todos ou nenhum; "best-effort" grava os
+// itens válidos e relata os que falharam
+const (
+	batchAtomic     = "atomic"
+	batchBestEffort = "best-effort"
+)
+
+// Resultado de um item do lote, na mesma posição em que ele foi enviado
+type BatchItemResult struct {
+	Index  int    `json:"index"`
+	Status string `json:"status"` // "created", "failed", "rolled_back" ou "skipped"
+	ID     int    `json:"id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Relatório devolvido por POST /users/batch
+type BatchReport struct {
+	Mode    string            `json:"mode"`
+	Created int               `json:"created"`
+	Failed  int               `json:"failed"`
+	Results []BatchItemResult `json:"results"`
+}
+
+// Manipulador para inserir vários usuários em uma única transação
+func handleBatchInsert(w http.ResponseWriter, r *http.Request) {
+	mode := r.URL.Query().Get("mode")
+	if mode == "" {
+		mode = batchAtomic
+	}
+	if mode != batchAtomic && mode != batchBestEffort {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("mode deve ser %q ou %q", batchAtomic, batchBestEffort))
+		return
+	}
+
+	var users []User
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBytes)).Decode(&users)
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("o corpo pode ter no máximo %d bytes", maxBatchBytes))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusBadRequest, "JSON inválido: "+err.Error())
+		return
+	}
+	if len(users) == 0 {
+		writeError(w, http.StatusBadRequest, "o lote precisa ter ao menos um usuário")
+		return
+	}
+	if len(users) > maxBatchSize {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("o lote pode ter no máximo %d usuários", maxBatchSize))
+		return
+	}
+
+	report, err := insertBatch(r.Context(), users, mode == batchAtomic)
+	if err != nil {
+		writeServerError(w, r, err)
+		return
+	}
+	report.Mode = mode
+
+	status := http.StatusCreated
+	switch {
+	case report.Created == 0:
+		status = http.StatusUnprocessableEntity
+	case report.Failed > 0:
+		status = http.StatusMultiStatus
+	}
+	writeJSON(w, status, report)
+}
+
+// Insere os usuários com um prepared statement dentro de uma transação.
+// Cada item roda em um savepoint, então no modo best-effort um item que
+// falha é desfeito sem afetar os demais; no modo atômico a primeira falha
+// desfaz a transação inteira. O erro retornado é apenas o da transação em
+// si; as falhas dos itens vão para o relatório.
+func insertBatch(ctx context.Context, users []User, atomic bool) (*BatchReport, error) {
+	report := &BatchReport{Results: make([]BatchItemResult, len(users))}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO users (name, email) VALUES (?, ?)")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+
+	for i, user := range users {
+		res := &report.Results[i]
+		res.Index = i
+
+		id, itemErr, err := insertBatchItem(ctx, tx, stmt, user)
+		if err != nil {
+			return nil, err
+		}
+		if itemErr != nil {
+			res.Status, res.Error = "failed", itemErr.Error()
+			report.Failed++
+			if atomic {
+				rollBackBatch(report, i)
+				return report, nil
+			}
+			continue
+		}
+
+		res.Status, res.ID = "created", id
+		report.Created++
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// Insere um item dentro de um savepoint, que é desfeito se o item falhar.
+// itemErr é a falha do próprio item, que vai para o relatório; err é uma
+// falha do savepoint, que deixa a transação em estado incerto e por isso
+// aborta o lote inteiro.
+func insertBatchItem(ctx context.Context, tx *sql.Tx, stmt *sql.Stmt, user User) (id int, itemErr, err error) {
+	if err := user.Validate(); err != nil {
+		return 0, err, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT batch_item"); err != nil {
+		return 0, nil, err
+	}
+
+	id, itemErr = execBatchItem(ctx, stmt, user)
+	if itemErr != nil {
+		if _, err := tx.ExecContext(ctx, "ROLLBACK TO batch_item"); err != nil {
+			return 0, nil, err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "RELEASE batch_item"); err != nil {
+		return 0, nil, err
+	}
+	return id, itemErr, nil
+}
+
+// Executa o INSERT de um item; o erro do banco fica no log e o cliente
+// recebe uma mensagem genérica
+func execBatchItem(ctx context.Context, stmt *sql.Stmt, user User) (int, error) {
+	result, err := stmt.ExecContext(ctx, user.Name, user.Email)
+	if err != nil {
+		log.Printf("inserindo item do lote: %v", err)
+		return 0, errors.New("erro ao inserir no banco")
+	}
+
+	lastID, err := result.LastInsertId()
+	if err != nil {
+		log.Printf("lendo o ID do item do lote: %v", err)
+		return 0, errors.New("erro ao inserir no banco")
+	}
+	return int(lastID), nil
+}
+
+// Marca como desfeitos os itens gravados antes do que falhou no índice
+// failed, e como pulados os seguintes, que nem chegaram a ser tentados
+func rollBackBatch(report *BatchReport, failed int) {
+	for i := range report.Results {
+		switch {
+		case i < failed:
+			report.Results[i] = BatchItemResult{
+				Index:  i,
+				Status: "rolled_back",
+				Error:  fmt.Sprintf("o lote foi desfeito pela falha do item %d", failed),
+			}
+		case i > failed:
+			report.Results[i] = BatchItemResult{
+				Index:  i,
+				Status: "skipped",
+				Error:  fmt.Sprintf("o item não foi tentado por causa da falha do item %d", failed),
+			}
+		}
+	}
+	report.Created = 0
+}
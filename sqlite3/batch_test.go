@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInsertBatch(t *testing.T) {
+	users := []User{
+		{Name: "Ana", Email: "ana@example.com"},
+		{Name: "", Email: "sem-nome@example.com"},
+		{Name: "Bruno", Email: "bruno@example.com"},
+	}
+
+	tests := []struct {
+		name        string
+		users       []User
+		atomic      bool
+		wantStatus  []string
+		wantCreated int
+		wantFailed  int
+		wantRows    int
+	}{
+		{"atômico sem falhas", []User{users[0], users[2]}, true, []string{"created", "created"}, 2, 0, 2},
+		{"atômico com falha", users, true, []string{"rolled_back", "failed", "skipped"}, 0, 1, 0},
+		{"atômico com falha no primeiro", []User{users[1], users[0]}, true, []string{"failed", "skipped"}, 0, 1, 0},
+		{"best-effort com falha", users, false, []string{"created", "failed", "created"}, 2, 1, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setupTestDB(t)
+
+			report, err := insertBatch(context.Background(), tt.users, tt.atomic)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if report.Created != tt.wantCreated || report.Failed != tt.wantFailed {
+				t.Errorf("created = %d, failed = %d, esperava %d e %d", report.Created, report.Failed, tt.wantCreated, tt.wantFailed)
+			}
+			for i, res := range report.Results {
+				if res.Index != i || res.Status != tt.wantStatus[i] {
+					t.Errorf("item %d: %+v, esperava status %q", i, res, tt.wantStatus[i])
+				}
+				if (res.Status == "created") != (res.ID != 0) {
+					t.Errorf("item %d: status %q com id %d", i, res.Status, res.ID)
+				}
+			}
+			if n := countUsers(t); n != tt.wantRows {
+				t.Errorf("%d usuários gravados, esperava %d", n, tt.wantRows)
+			}
+		})
+	}
+}
+
+// Os IDs do relatório são os das linhas gravadas
+func TestInsertBatchIDs(t *testing.T) {
+	setupTestDB(t)
+
+	report, err := insertBatch(context.Background(), []User{
+		{Name: "Ana", Email: "ana@example.com"},
+		{Name: "Bruno", Email: "bruno@example.com"},
+	}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, res := range report.Results {
+		var name string
+		if err := db.QueryRow("SELECT name FROM users WHERE id = ?", res.ID).Scan(&name); err != nil {
+			t.Errorf("item %d: id %d não encontrado: %v", res.Index, res.ID, err)
+		}
+	}
+}
+
+// Um item recusado pelo banco é desfeito pelo savepoint sem afetar os demais
+func TestInsertBatchDatabaseError(t *testing.T) {
+	setupTestDB(t)
+	_, err := db.Exec(`CREATE TRIGGER reject_users BEFORE INSERT ON users WHEN NEW.email = 'recusado@example.com'
+		BEGIN SELECT RAISE(ABORT, 'recusado'); END`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := insertBatch(context.Background(), []User{
+		{Name: "Ana", Email: "ana@example.com"},
+		{Name: "Recusado", Email: "recusado@example.com"},
+		{Name: "Bruno", Email: "bruno@example.com"},
+	}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Created != 2 || report.Failed != 1 || report.Results[1].Error != "erro ao inserir no banco" {
+		t.Errorf("relatório = %+v", report)
+	}
+	if n := countUsers(t); n != 2 {
+		t.Errorf("%d usuários gravados, esperava 2", n)
+	}
+}
+
+// Um corpo maior que maxBatchBytes é recusado durante a leitura
+func TestHandleBatchInsertBodyTooLarge(t *testing.T) {
+	setupTestDB(t)
+
+	body := `[{"name": "Ana", "email": "` + strings.Repeat("a", maxBatchBytes) + `@example.com"}]`
+	w := httptest.NewRecorder()
+	handleBatchInsert(w, httptest.NewRequest(http.MethodPost, "/users/batch", strings.NewReader(body)))
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, esperava %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+	if n := countUsers(t); n != 0 {
+		t.Errorf("%d usuários gravados, esperava 0", n)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// memoryPath é o caminho especial do SQLite para um banco que existe apenas
+// na memória do processo.
+const memoryPath = ":memory:"
+
+// Configuração de acesso ao banco de dados
+type DBConfig struct {
+	Path        string        // caminho do arquivo, ou ":memory:"
+	JournalMode string        // WAL, DELETE, TRUNCATE...; ignorado em memória
+	BusyTimeout time.Duration // quanto esperar por um lock antes de falhar com SQLITE_BUSY
+	Synchronous string        // OFF, NORMAL, FULL ou EXTRA
+}
+
+// Valores aceitos pelo SQLite; o go-sqlite3 rejeita os demais, mas o
+// modernc.org/sqlite os ignoraria sem avisar, então a validação é feita
+// aqui para os dois drivers
+var (
+	journalModes = []string{"DELETE", "TRUNCATE", "PERSIST", "MEMORY", "WAL", "OFF"}
+	syncLevels   = []string{"OFF", "NORMAL", "FULL", "EXTRA"}
+)
+
+// Confere os valores da configuração
+func (c DBConfig) Validate() error {
+	if c.Path == "" {
+		return fmt.Errorf("o caminho do banco de dados é obrigatório")
+	}
+	if c.JournalMode != "" && !slices.Contains(journalModes, strings.ToUpper(c.JournalMode)) {
+		return fmt.Errorf("journal_mode inválido %q, use um de %s", c.JournalMode, strings.Join(journalModes, ", "))
+	}
+	if c.Synchronous != "" && !slices.Contains(syncLevels, strings.ToUpper(c.Synchronous)) {
+		return fmt.Errorf("synchronous inválido %q, use um de %s", c.Synchronous, strings.Join(syncLevels, ", "))
+	}
+	if c.BusyTimeout < 0 {
+		return fmt.Errorf("busy timeout não pode ser negativo")
+	}
+	return nil
+}
+
+// DSN monta a string de conexão do driver em uso a partir da configuração.
+// As chaves estrangeiras são sempre habilitadas.
+func (c DBConfig) DSN() string {
+	params := driverParams(c).Encode()
+	if c.Path == memoryPath {
+		return "file::memory:?" + params
+	}
+	return "file:" + escapePath(c.Path) + "?" + params
+}
+
+// Escapa o caminho para a URI "file:", em que "?", "#" e "%" teriam outro
+// significado; o SQLite decodifica os escapes ao abrir o arquivo. As barras
+// continuam legíveis, já que separam os diretórios também na URI.
+func escapePath(path string) string {
+	return strings.ReplaceAll(url.PathEscape(path), "%2F", "/")
+}
+
+// Abre o banco de dados e confere se ele está íntegro antes de o servidor
+// começar a atender requisições.
+func openDB(cfg DBConfig) (*sql.DB, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open(driverName, cfg.DSN())
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Path == memoryPath {
+		// Cada conexão com ":memory:" abre um banco novo e vazio, então o
+		// pool precisa ficar com uma única conexão que nunca é fechada.
+		db.SetMaxOpenConns(1)
+		db.SetConnMaxIdleTime(0)
+		db.SetConnMaxLifetime(0)
+	}
+
+	if err := checkDB(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("abrindo %s: %w", cfg.Path, err)
+	}
+
+	return db, nil
+}
+
+// Abre um segundo pool, somente leitura (mode=ro), sobre o arquivo do banco,
+// usado pelas consultas de admin: por ele nem um PRAGMA nem um ATTACH
+// conseguem escrever, já que os bancos anexados herdam o modo. Um banco em
+// memória não pode ser aberto de novo, então nesse caso devolve nil e as
+// consultas usam o pool principal com PRAGMA query_only.
+func openReadOnlyDB(cfg DBConfig) (*sql.DB, error) {
+	if cfg.Path == memoryPath {
+		return nil, nil
+	}
+
+	// O journal_mode já foi definido pelo pool principal e não pode ser
+	// alterado por uma conexão somente leitura
+	cfg.JournalMode = ""
+	roDB, err := sql.Open(driverName, cfg.DSN()+"&mode=ro")
+	if err != nil {
+		return nil, err
+	}
+	if err := roDB.Ping(); err != nil {
+		roDB.Close()
+		return nil, fmt.Errorf("abrindo %s somente para leitura: %w", cfg.Path, err)
+	}
+	return roDB, nil
+}
+
+// Cria a tabela de usuários caso ela ainda não exista
+func createTables(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, name TEXT, email TEXT)")
+	return err
+}
+
+// Verificações feitas na inicialização: o arquivo precisa passar no
+// PRAGMA integrity_check e as chaves estrangeiras precisam estar ativas.
+func checkDB(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA integrity_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var problems []string
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return err
+		}
+		if msg != "ok" {
+			problems = append(problems, msg)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("integrity_check falhou: %s", strings.Join(problems, "; "))
+	}
+
+	var foreignKeys bool
+	if err := db.QueryRow("PRAGMA foreign_keys").Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if !foreignKeys {
+		return fmt.Errorf("não foi possível habilitar as chaves estrangeiras")
+	}
+
+	return nil
+}
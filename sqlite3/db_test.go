@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Troca a variável global db por um banco em memória com a tabela users
+func setupTestDB(t *testing.T) {
+	t.Helper()
+
+	testDB, err := openDB(DBConfig{Path: memoryPath, BusyTimeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createTables(testDB); err != nil {
+		t.Fatal(err)
+	}
+
+	db = testDB
+	t.Cleanup(func() {
+		testDB.Close()
+		db = nil
+	})
+}
+
+// Como setupTestDB, mas com o banco em um arquivo temporário e o pool
+// somente leitura das consultas de admin em queryDB
+func setupFileTestDB(t *testing.T) {
+	t.Helper()
+
+	cfg := DBConfig{Path: filepath.Join(t.TempDir(), "users.db"), JournalMode: "WAL", BusyTimeout: time.Second}
+	testDB, err := openDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := createTables(testDB); err != nil {
+		t.Fatal(err)
+	}
+	roDB, err := openReadOnlyDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, queryDB = testDB, roDB
+	t.Cleanup(func() {
+		roDB.Close()
+		testDB.Close()
+		db, queryDB = nil, nil
+	})
+}
+
+// O pool somente leitura recusa escritas, mesmo depois de desligar o
+// query_only
+func TestOpenReadOnlyDB(t *testing.T) {
+	setupFileTestDB(t)
+
+	if _, err := queryDB.Exec("PRAGMA query_only = OFF"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queryDB.Exec("INSERT INTO users (name, email) VALUES ('Ana', 'ana@example.com')"); err == nil {
+		t.Error("o INSERT pelo pool somente leitura não falhou")
+	}
+
+	// Em memória não há um segundo pool
+	if roDB, err := openReadOnlyDB(DBConfig{Path: memoryPath}); roDB != nil || err != nil {
+		t.Errorf("openReadOnlyDB(:memory:) = %v, %v", roDB, err)
+	}
+}
+
+func countUsers(t *testing.T) int {
+	t.Helper()
+
+	var n int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDBConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     DBConfig
+		wantErr string
+	}{
+		{"arquivo", DBConfig{Path: "users.db", JournalMode: "WAL", Synchronous: "NORMAL", BusyTimeout: time.Second}, ""},
+		{"memória", DBConfig{Path: memoryPath}, ""},
+		{"minúsculas", DBConfig{Path: "users.db", JournalMode: "wal", Synchronous: "full"}, ""},
+		{"sem caminho", DBConfig{JournalMode: "WAL"}, "caminho"},
+		{"journal_mode inválido", DBConfig{Path: "users.db", JournalMode: "WALL"}, "journal_mode"},
+		{"synchronous inválido", DBConfig{Path: "users.db", Synchronous: "SOMETIMES"}, "synchronous"},
+		{"busy timeout negativo", DBConfig{Path: "users.db", BusyTimeout: -time.Second}, "busy timeout"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.cfg.Validate()
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("erro inesperado: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("esperava um erro sobre %q", tt.wantErr)
+			case err != nil && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("erro %q não menciona %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDBConfigDSN(t *testing.T) {
+	cfg := DBConfig{Path: "dados/users.db", JournalMode: "WAL", Synchronous: "NORMAL", BusyTimeout: 5 * time.Second}
+
+	dsn := cfg.DSN()
+	path, query, ok := strings.Cut(dsn, "?")
+	if !ok || path != "file:dados/users.db" {
+		t.Fatalf("DSN = %q", dsn)
+	}
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := driverParams(cfg); params.Encode() != want.Encode() {
+		t.Errorf("parâmetros = %v, esperava %v", params, want)
+	}
+
+	// Em memória o journal_mode não se aplica
+	cfg.Path = memoryPath
+	dsn = cfg.DSN()
+	if !strings.HasPrefix(dsn, "file::memory:?") {
+		t.Errorf("DSN em memória = %q", dsn)
+	}
+	if strings.Contains(strings.ToLower(dsn), "journal_mode") {
+		t.Errorf("DSN em memória tem journal_mode: %q", dsn)
+	}
+}
+
+func TestOpenDBFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	cfg := DBConfig{Path: path, JournalMode: "WAL", Synchronous: "NORMAL", BusyTimeout: 2 * time.Second}
+
+	testDB, err := openDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDB.Close()
+
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("o arquivo do banco não foi criado: %v", err)
+	}
+
+	pragmas := []struct {
+		pragma string
+		want   string
+	}{
+		{"journal_mode", "wal"},
+		{"synchronous", "1"}, // NORMAL
+		{"foreign_keys", "1"},
+		{"busy_timeout", "2000"},
+	}
+	for _, p := range pragmas {
+		var got string
+		if err := testDB.QueryRow("PRAGMA " + p.pragma).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != p.want {
+			t.Errorf("PRAGMA %s = %s, esperava %s", p.pragma, got, p.want)
+		}
+	}
+
+	// Os dados ficam no arquivo e aparecem ao abrir o banco de novo
+	if err := createTables(testDB); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testDB.Exec("INSERT INTO users (name, email) VALUES ('Ana', 'ana@example.com')"); err != nil {
+		t.Fatal(err)
+	}
+	testDB.Close()
+
+	testDB, err = openDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDB.Close()
+	var name string
+	if err := testDB.QueryRow("SELECT name FROM users").Scan(&name); err != nil || name != "Ana" {
+		t.Errorf("depois de reabrir: name = %q, err = %v", name, err)
+	}
+}
+
+// Caracteres com significado numa URI fazem parte do nome do arquivo
+func TestOpenDBEscapesPath(t *testing.T) {
+	for _, name := range []string{"a?mode=ro.db", "a#b.db", "100%.db", "com espaço.db"} {
+		path := filepath.Join(t.TempDir(), name)
+		testDB, err := openDB(DBConfig{Path: path, JournalMode: "WAL"})
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		err = createTables(testDB)
+		testDB.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s: o arquivo do banco não foi criado: %v", name, err)
+		}
+	}
+}
+
+func TestOpenDBMemory(t *testing.T) {
+	testDB, err := openDB(DBConfig{Path: memoryPath, JournalMode: "WAL"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer testDB.Close()
+
+	// Todas as consultas precisam ver o mesmo banco, mesmo em paralelo
+	if err := createTables(testDB); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := testDB.Exec("INSERT INTO users (name, email) VALUES ('Ana', 'ana@example.com')")
+			done <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var n int
+	if err := testDB.QueryRow("SELECT COUNT(*) FROM users").Scan(&n); err != nil || n != 4 {
+		t.Errorf("COUNT(*) = %d, err = %v", n, err)
+	}
+}
+
+func TestOpenDBRejectsInvalidFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.db")
+	if err := os.WriteFile(path, []byte(strings.Repeat("isto não é um banco SQLite\n", 200)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	testDB, err := openDB(DBConfig{Path: path, JournalMode: "WAL"})
+	if err == nil {
+		testDB.Close()
+		t.Fatal("openDB aceitou um arquivo que não é um banco SQLite")
+	}
+
+	if _, err := openDB(DBConfig{Path: path, JournalMode: "WALL"}); err == nil || !strings.Contains(err.Error(), "journal_mode") {
+		t.Errorf("openDB com configuração inválida: %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+//go:build cgo && !purego
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// Driver padrão: github.com/mattn/go-sqlite3, que compila o SQLite em C e
+// por isso exige cgo
+const driverName = "sqlite3"
+
+// Parâmetros de conexão no formato do go-sqlite3
+func driverParams(c DBConfig) url.Values {
+	params := url.Values{}
+	params.Set("_busy_timeout", fmt.Sprint(c.BusyTimeout.Milliseconds()))
+	params.Set("_foreign_keys", "on")
+	if c.Synchronous != "" {
+		params.Set("_synchronous", c.Synchronous)
+	}
+	if c.Path != memoryPath && c.JournalMode != "" {
+		params.Set("_journal_mode", c.JournalMode)
+	}
+	return params
+}
+
+// Registra na conexão um authorizer que recusa ATTACH, DETACH e PRAGMA
+// enquanto uma consulta de admin roda: mesmo que uma dessas instruções
+// passasse pelas checagens, o SQLite não a prepararia. A função devolvida
+// remove o authorizer antes de a conexão voltar ao pool.
+func restrictQueryConn(conn *sql.Conn) (func(), error) {
+	set := func(callback func(int, string, string, string) int) error {
+		return conn.Raw(func(c any) error {
+			c.(*sqlite3.SQLiteConn).RegisterAuthorizer(callback)
+			return nil
+		})
+	}
+
+	err := set(func(op int, _, _, _ string) int {
+		switch op {
+		case sqlite3.SQLITE_ATTACH, sqlite3.SQLITE_DETACH, sqlite3.SQLITE_PRAGMA:
+			return sqlite3.SQLITE_DENY
+		}
+		return sqlite3.SQLITE_OK
+	})
+	return func() { set(nil) }, err
+}
@@ -0,0 +1,46 @@
+//go:build cgo && !purego
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Com o authorizer, o SQLite não prepara ATTACH nem PRAGMA, e a conexão
+// volta ao normal depois
+func TestRestrictQueryConn(t *testing.T) {
+	setupTestDB(t)
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	unrestrict, err := restrictQueryConn(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	evil := filepath.Join(t.TempDir(), "evil.db")
+	if _, err := conn.ExecContext(ctx, "ATTACH ? AS evil", evil); err == nil {
+		t.Error("o ATTACH não foi recusado")
+	}
+	if _, err := os.Stat(evil); err == nil {
+		t.Error("o ATTACH criou o arquivo")
+	}
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = OFF"); err == nil {
+		t.Error("o PRAGMA não foi recusado")
+	}
+	if _, err := conn.ExecContext(ctx, "SELECT COUNT(*) FROM users"); err != nil {
+		t.Errorf("SELECT recusado: %v", err)
+	}
+
+	unrestrict()
+	if _, err := conn.ExecContext(ctx, "PRAGMA query_only = OFF"); err != nil {
+		t.Errorf("o PRAGMA continuou recusado: %v", err)
+	}
+}
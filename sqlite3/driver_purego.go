@@ -0,0 +1,38 @@
+//go:build !cgo || purego
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/url"
+
+	_ "modernc.org/sqlite"
+)
+
+// Driver sem cgo: modernc.org/sqlite, o SQLite traduzido para Go. É usado
+// com -tags purego ou quando o build é feito com CGO_ENABLED=0
+const driverName = "sqlite"
+
+// Parâmetros de conexão no formato do modernc.org/sqlite, que aplica cada
+// _pragma ao abrir cada conexão
+func driverParams(c DBConfig) url.Values {
+	params := url.Values{}
+	params.Add("_pragma", fmt.Sprintf("busy_timeout(%d)", c.BusyTimeout.Milliseconds()))
+	params.Add("_pragma", "foreign_keys(1)")
+	if c.Synchronous != "" {
+		params.Add("_pragma", fmt.Sprintf("synchronous(%s)", c.Synchronous))
+	}
+	if c.Path != memoryPath && c.JournalMode != "" {
+		params.Add("_pragma", fmt.Sprintf("journal_mode(%s)", c.JournalMode))
+	}
+	return params
+}
+
+// O modernc.org/sqlite não expõe sqlite3_set_authorizer, então aqui ATTACH,
+// DETACH e PRAGMA ficam de fora apenas pelas checagens de checkReadOnlySQL:
+// uma única instrução que começa com SELECT ou WITH não pode conter nenhum
+// deles.
+func restrictQueryConn(conn *sql.Conn) (func(), error) {
+	return func() {}, nil
+}
@@ -3,11 +3,15 @@ package main
 import (
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-
-	_ "github.com/mattn/go-sqlite3"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Struct para representar um usuário
@@ -17,53 +21,159 @@ type User struct {
 	Email string `json:"email"`
 }
 
+// Confere os campos obrigatórios de um usuário a ser inserido
+func (u User) Validate() error {
+	if strings.TrimSpace(u.Name) == "" {
+		return errors.New("name é obrigatório")
+	}
+	if strings.TrimSpace(u.Email) == "" {
+		return errors.New("email é obrigatório")
+	}
+	return nil
+}
+
 var db *sql.DB
 
+// Pool somente leitura das consultas de admin; nil com o banco em memória
+var queryDB *sql.DB
+
 func main() {
-	// Abrir o banco de dados em memória
+	// Configuração do banco; cada flag pode vir também de uma variável de ambiente
+	var cfg DBConfig
+	flag.StringVar(&cfg.Path, "db", envOr("DB_PATH", "users.db"), `arquivo do banco de dados, ou ":memory:" para um banco em memória`)
+	flag.StringVar(&cfg.JournalMode, "journal-mode", envOr("DB_JOURNAL_MODE", "WAL"), "journal_mode do SQLite (ignorado em memória)")
+	flag.DurationVar(&cfg.BusyTimeout, "busy-timeout", envDurationOr("DB_BUSY_TIMEOUT", 5*time.Second), "quanto esperar por um lock do banco")
+	flag.StringVar(&cfg.Synchronous, "synchronous", envOr("DB_SYNCHRONOUS", "NORMAL"), "nível de synchronous do SQLite: OFF, NORMAL, FULL ou EXTRA")
+	adminToken := flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "token exigido pelas rotas /admin; vazio desliga essas rotas")
+	flag.Parse()
+
+	// Abrir o banco de dados, em arquivo ou em memória
 	var err error
-	db, err = sql.Open("sqlite3", ":memory:")
+	db, err = openDB(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
+	var journalMode string
+	if err := db.QueryRow("PRAGMA journal_mode").Scan(&journalMode); err != nil {
+		log.Fatalf("lendo o journal_mode: %v", err)
+	}
+	fmt.Printf("Banco de dados: %s (driver=%s, journal_mode=%s)\n", cfg.Path, driverName, journalMode)
+
 	// Criar a tabela de usuários
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS users (id INTEGER PRIMARY KEY, name TEXT, email TEXT)")
+	if err := createTables(db); err != nil {
+		log.Fatal(err)
+	}
+
+	// O pool somente leitura é aberto depois, quando o arquivo já existe
+	queryDB, err = openReadOnlyDB(cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if queryDB != nil {
+		defer queryDB.Close()
+	}
+
+	// Rotas da API; um método diferente do registrado responde 405 com o
+	// header Allow, e qualquer outro caminho responde 404
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /users", handleUsers)              // Rota para buscar todos os usuários
+	mux.HandleFunc("POST /user", handleInsert)             // Rota para inserir um usuário
+	mux.HandleFunc("GET /user/{id}", handleGetUser)        // Rota para buscar um usuário por ID
+	mux.HandleFunc("POST /users/batch", handleBatchInsert) // Rota para inserir vários usuários
+	mux.HandleFunc("/users", methodNotAllowed("GET"))
+	mux.HandleFunc("/user", methodNotAllowed("POST"))
+	mux.HandleFunc("/user/{id}", methodNotAllowed("GET"))
+	mux.HandleFunc("/users/batch", methodNotAllowed("POST"))
+
+	// Rotas de inspeção do banco, somente leitura
+	mux.HandleFunc("GET /admin/tables", requireAdmin(*adminToken, handleAdminTables))
+	mux.HandleFunc("POST /admin/query", requireAdmin(*adminToken, handleAdminQuery))
+	mux.HandleFunc("/admin/tables", methodNotAllowed("GET"))
+	mux.HandleFunc("/admin/query", methodNotAllowed("POST"))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "rota não encontrada")
+	})
+
+	fmt.Println("Servidor rodando em http://localhost:8081")
+	log.Fatal(http.ListenAndServe(":8081", mux))
+}
+
+// Lê uma variável de ambiente, usando def quando ela não está definida
+func envOr(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// Lê uma duração (ex.: "5s") de uma variável de ambiente
+func envDurationOr(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("%s inválido: %v", name, err)
+	}
+	return d
+}
+
+// Responde em JSON com o status informado
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("codificando resposta: %v", err)
+	}
+}
 
-	// Rotas da API
-	http.HandleFunc("/users", handleUsers)   // Rota para buscar todos os usuários
-	http.HandleFunc("/user", handleInsert)   // Rota para inserir um usuário
-	http.HandleFunc("/user/", handleGetUser) // Rota para buscar um usuário por ID
+// Responde um erro no formato {"error": "..."}
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
 
-	fmt.Println("Servidor rodando em http://localhost:8080")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+// Registra o erro do banco e responde 500 sem expor os detalhes ao cliente
+func writeServerError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("%s %s: %v", r.Method, r.URL.Path, err)
+	writeError(w, http.StatusInternalServerError, "erro interno")
+}
+
+// Handler para uma rota chamada com um método que ela não aceita
+func methodNotAllowed(allowed string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", allowed)
+		writeError(w, http.StatusMethodNotAllowed, "método não permitido")
+	}
 }
 
 // Manipulador para buscar todos os usuários
 func handleUsers(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query("SELECT id, name, email FROM users")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	defer rows.Close()
 
-	var users []User
+	users := []User{}
 	for rows.Next() {
 		var user User
 		err := rows.Scan(&user.ID, &user.Name, &user.Email)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeServerError(w, r, err)
 			return
 		}
 		users = append(users, user)
 	}
+	if err := rows.Err(); err != nil {
+		writeServerError(w, r, err)
+		return
+	}
 
-	json.NewEncoder(w).Encode(users)
+	writeJSON(w, http.StatusOK, users)
 }
 
 // Manipulador para inserir um usuário
@@ -71,36 +181,47 @@ func handleInsert(w http.ResponseWriter, r *http.Request) {
 	var user User
 	err := json.NewDecoder(r.Body).Decode(&user)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "JSON inválido: "+err.Error())
+		return
+	}
+	if err := user.Validate(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	result, err := db.Exec("INSERT INTO users (name, email) VALUES (?, ?)", user.Name, user.Email)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 
 	lastID, err := result.LastInsertId()
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeServerError(w, r, err)
 		return
 	}
 	user.ID = int(lastID)
 
-	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(user)
+	writeJSON(w, http.StatusCreated, user)
 }
 
 // Manipulador para buscar um usuário por ID
 func handleGetUser(w http.ResponseWriter, r *http.Request) {
-	id := r.URL.Path[len("/user/"):]
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil || id < 1 {
+		writeError(w, http.StatusBadRequest, "ID inválido")
+		return
+	}
+
 	var user User
-	err := db.QueryRow("SELECT id, name, email FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Email)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
+	err = db.QueryRow("SELECT id, name, email FROM users WHERE id=?", id).Scan(&user.ID, &user.Name, &user.Email)
+	if errors.Is(err, sql.ErrNoRows) {
+		writeError(w, http.StatusNotFound, "usuário não encontrado")
+		return
+	} else if err != nil {
+		writeServerError(w, r, err)
 		return
 	}
 
-	json.NewEncoder(w).Encode(user)
+	writeJSON(w, http.StatusOK, user)
 }
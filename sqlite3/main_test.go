@@ -0,0 +1,56 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUserValidate(t *testing.T) {
+	tests := []struct {
+		user    User
+		wantErr string
+	}{
+		{User{Name: "Ana", Email: "ana@example.com"}, ""},
+		{User{Name: "", Email: "ana@example.com"}, "name é obrigatório"},
+		{User{Name: "  ", Email: "ana@example.com"}, "name é obrigatório"},
+		{User{Name: "Ana", Email: "\t"}, "email é obrigatório"},
+	}
+
+	for _, tt := range tests {
+		got := ""
+		if err := tt.user.Validate(); err != nil {
+			got = err.Error()
+		}
+		if got != tt.wantErr {
+			t.Errorf("Validate(%+v) = %q, esperava %q", tt.user, got, tt.wantErr)
+		}
+	}
+}
+
+func TestHandleInsertValidates(t *testing.T) {
+	setupTestDB(t)
+
+	tests := []struct {
+		body       string
+		wantStatus int
+	}{
+		{`{"name": "Ana", "email": "ana@example.com"}`, http.StatusCreated},
+		{`{"name": "", "email": "sem-nome@example.com"}`, http.StatusBadRequest},
+		{`{"name": "Sem email"}`, http.StatusBadRequest},
+		{`{"name":`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handleInsert(w, httptest.NewRequest(http.MethodPost, "/user", strings.NewReader(tt.body)))
+		if w.Code != tt.wantStatus {
+			t.Errorf("POST /user %s: status %d, esperava %d", tt.body, w.Code, tt.wantStatus)
+		}
+	}
+
+	if n := countUsers(t); n != 1 {
+		t.Errorf("%d usuários gravados, esperava 1", n)
+	}
+}